@@ -0,0 +1,321 @@
+package balancer
+
+import (
+	"fmt"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// AffinityRule requires the topics matching Topic and the ones matching With
+// (both topic patterns, see CompileTopicPattern) to share their brokers or,
+// if Anti is set, not to share them. A topic violates an affinity rule on a
+// broker hosting none of the topics on the other side of the rule, and an
+// anti-affinity rule on a broker hosting any of them. If Penalty is 0 the
+// rule is a hard constraint, that the placement steps never violate;
+// otherwise each violation adds Penalty to the unbalance of the candidate
+// moves.
+type AffinityRule struct {
+	Topic   string  `json:"topic"`
+	With    string  `json:"with"`
+	Anti    bool    `json:"anti,omitempty"`
+	Penalty float64 `json:"penalty,omitempty"`
+}
+
+// Validate returns an error if the patterns of the rule are not valid or its
+// penalty is negative
+func (rule AffinityRule) Validate() error {
+	_, err := compileAffinityRule(rule)
+	return err
+}
+
+type affinityRule struct {
+	AffinityRule
+	topic, with TopicMatcher
+}
+
+func compileAffinityRule(rule AffinityRule) (affinityRule, error) {
+	if rule.Penalty < 0 {
+		return affinityRule{}, fmt.Errorf("affinity rule %+v has negative penalty", rule)
+	}
+	topic, err := CompileTopicPattern(rule.Topic)
+	if err != nil {
+		return affinityRule{}, fmt.Errorf("affinity rule %+v: %s", rule, err)
+	}
+	with, err := CompileTopicPattern(rule.With)
+	if err != nil {
+		return affinityRule{}, fmt.Errorf("affinity rule %+v: %s", rule, err)
+	}
+
+	return affinityRule{rule, topic, with}, nil
+}
+
+func (rule affinityRule) kind() string {
+	if rule.Anti {
+		return "anti-affinity"
+	}
+	return "affinity"
+}
+
+// affinityMatch records which sides of a rule a topic matches
+type affinityMatch struct {
+	topic, with bool
+}
+
+// affinityCounts are the number of topics on a broker matching the topic
+// side of a rule, the with side and both
+type affinityCounts struct {
+	topic, with, both int
+}
+
+func (c affinityCounts) add(m affinityMatch, n int) affinityCounts {
+	if m.topic {
+		c.topic += n
+	}
+	if m.with {
+		c.with += n
+	}
+	if m.topic && m.with {
+		c.both += n
+	}
+	return c
+}
+
+// violated reports whether a topic matching m, counted in c, violates the
+// rule
+func (c affinityCounts) violated(m affinityMatch, anti bool) bool {
+	// the topics on the other side of the rule, except the topic itself
+	with, topic := c.with, c.topic
+	if m.with {
+		with--
+	}
+	if m.topic {
+		topic--
+	}
+
+	if anti {
+		return m.topic && with > 0 || m.with && topic > 0
+	}
+	return m.topic && with == 0 || m.with && topic == 0
+}
+
+// violations returns the number of topics counted in c violating the rule
+func (c affinityCounts) violations(anti bool) int {
+	v := 0
+	for _, m := range []affinityMatch{{true, false}, {false, true}, {true, true}} {
+		n := c.topic - c.both
+		switch {
+		case !m.topic:
+			n = c.with - c.both
+		case m.with:
+			n = c.both
+		}
+		if n > 0 && c.violated(m, anti) {
+			v += n
+		}
+	}
+	return v
+}
+
+// affinityIndex counts the topics matching the affinity rules on each broker
+type affinityIndex struct {
+	rules []affinityRule
+	// the sides of each rule matched by each topic, nil if the topic matches
+	// no rule
+	matches map[model.TopicName][]affinityMatch
+	// the number of partitions of each topic matching any rule with a replica
+	// on each broker, and the counts of each rule on each broker
+	replicas map[model.BrokerID]map[model.TopicName]int
+	counts   map[model.BrokerID][]affinityCounts
+}
+
+func newAffinityIndex(pl *model.PartitionList, rules []AffinityRule) (*affinityIndex, error) {
+	ai := &affinityIndex{
+		matches:  make(map[model.TopicName][]affinityMatch),
+		replicas: make(map[model.BrokerID]map[model.TopicName]int),
+		counts:   make(map[model.BrokerID][]affinityCounts),
+	}
+	for _, rule := range rules {
+		r, err := compileAffinityRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		ai.rules = append(ai.rules, r)
+	}
+
+	for _, p := range pl.Partitions {
+		ai.update(p.Topic, nil, p.Replicas)
+	}
+
+	return ai, nil
+}
+
+// affinityIndex returns the affinityIndex of the partition list, using the
+// one of the State being balanced if pl is its partition list, or nil if
+// there are no affinity rules
+func (cfg RebalanceConfig) affinityIndex(pl *model.PartitionList) (*affinityIndex, error) {
+	if len(cfg.Affinities) == 0 {
+		return nil, nil
+	}
+	if cfg.state != nil && cfg.state.pl == pl {
+		return cfg.state.affinityIndex(cfg.Affinities)
+	}
+	return newAffinityIndex(pl, cfg.Affinities)
+}
+
+func (ai *affinityIndex) match(t model.TopicName) []affinityMatch {
+	m, found := ai.matches[t]
+	if found {
+		return m
+	}
+
+	for idx, rule := range ai.rules {
+		am := affinityMatch{rule.topic(t), rule.with(t)}
+		if am.topic || am.with {
+			if m == nil {
+				m = make([]affinityMatch, len(ai.rules))
+			}
+			m[idx] = am
+		}
+	}
+	ai.matches[t] = m
+
+	return m
+}
+
+// update updates the counts after the replicas of a partition of topic t
+// changed from old
+func (ai *affinityIndex) update(t model.TopicName, old, replicas []model.BrokerID) {
+	m := ai.match(t)
+	if m == nil {
+		return
+	}
+
+	for _, r := range old {
+		if !inBrokerList(replicas, r) {
+			ai.replicas[r][t]--
+			if ai.replicas[r][t] == 0 {
+				delete(ai.replicas[r], t)
+				ai.add(r, m, -1)
+			}
+			if len(ai.replicas[r]) == 0 {
+				delete(ai.replicas, r)
+				delete(ai.counts, r)
+			}
+		}
+	}
+	for _, r := range replicas {
+		if !inBrokerList(old, r) {
+			if ai.replicas[r] == nil {
+				ai.replicas[r] = make(map[model.TopicName]int)
+			}
+			ai.replicas[r][t]++
+			if ai.replicas[r][t] == 1 {
+				ai.add(r, m, 1)
+			}
+		}
+	}
+}
+
+func (ai *affinityIndex) add(b model.BrokerID, m []affinityMatch, n int) {
+	counts := ai.counts[b]
+	if counts == nil {
+		counts = make([]affinityCounts, len(ai.rules))
+		ai.counts[b] = counts
+	}
+	for idx := range counts {
+		counts[idx] = counts[idx].add(m[idx], n)
+	}
+}
+
+// delta returns the change in the number of violations of the hard rules,
+// and in the penalty of the soft ones, caused by moving a replica of a
+// partition of topic t from broker from to broker to. If from (or to) is -1
+// the replica is only added (or removed). It can be invoked on a nil index.
+func (ai *affinityIndex) delta(t model.TopicName, from, to model.BrokerID) (int, float64) {
+	if ai == nil {
+		return 0, 0
+	}
+	m := ai.matches[t]
+	if m == nil {
+		return 0, 0
+	}
+
+	var hard int
+	var soft float64
+	if from != -1 && ai.replicas[from][t] == 1 {
+		h, s := ai.change(ai.counts[from], m, -1)
+		hard, soft = hard+h, soft+s
+	}
+	if to != -1 && ai.replicas[to][t] == 0 {
+		h, s := ai.change(ai.counts[to], m, 1)
+		hard, soft = hard+h, soft+s
+	}
+
+	return hard, soft
+}
+
+func (ai *affinityIndex) change(counts []affinityCounts, m []affinityMatch, n int) (int, float64) {
+	var hard int
+	var soft float64
+	for idx, rule := range ai.rules {
+		if !m[idx].topic && !m[idx].with {
+			continue
+		}
+		var c affinityCounts
+		if counts != nil {
+			c = counts[idx]
+		}
+		d := c.add(m[idx], n).violations(rule.Anti) - c.violations(rule.Anti)
+		if rule.Penalty == 0 {
+			hard += d
+		} else {
+			soft += rule.Penalty * float64(d)
+		}
+	}
+
+	return hard, soft
+}
+
+// violations returns the replicas of the partitions violating the hard and
+// the soft rules
+func (ai *affinityIndex) violations(pl *model.PartitionList) (hard, soft []Violation) {
+	for _, p := range pl.Partitions {
+		m := ai.matches[p.Topic]
+		if m == nil {
+			continue
+		}
+		for _, r := range p.Replicas {
+			for idx, rule := range ai.rules {
+				if !ai.counts[r][idx].violated(m[idx], rule.Anti) {
+					continue
+				}
+				v := Violation{p.Topic, p.Partition, fmt.Sprintf("replica on broker %d violates %s between %s and %s", r, rule.kind(), rule.Topic, rule.With)}
+				if rule.Penalty == 0 {
+					hard = append(hard, v)
+				} else {
+					soft = append(soft, v)
+				}
+			}
+		}
+	}
+
+	return hard, soft
+}
+
+// ValidateAffinities logs the number of replicas violating the affinity
+// rules. The following steps never add violations of hard rules and weigh the
+// penalties of the soft ones against the unbalance, but they don't fix the
+// existing violations of hard rules: Balancer.Report lists them.
+func ValidateAffinities(pl *model.PartitionList, cfg RebalanceConfig) (*model.PartitionList, error) {
+	ai, err := cfg.affinityIndex(pl)
+	if ai == nil || err != nil {
+		return nil, err
+	}
+
+	hard, soft := ai.violations(pl)
+	if len(hard) > 0 || len(soft) > 0 {
+		cfg.logf("ValidateAffinities: %d replicas violate hard affinity rules and %d soft ones", len(hard), len(soft))
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,245 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+func TestAffinityCounts(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		var topics []affinityMatch
+		var c affinityCounts
+		for j := rng.Intn(5); j > 0; j-- {
+			m := affinityMatch{rng.Intn(2) == 0, rng.Intn(2) == 0}
+			if !m.topic && !m.with {
+				continue
+			}
+			topics = append(topics, m)
+			c = c.add(m, 1)
+		}
+
+		for _, anti := range []bool{false, true} {
+			expected := 0
+			for _, m := range topics {
+				if c.violated(m, anti) {
+					expected++
+				}
+			}
+			if v := c.violations(anti); v != expected {
+				t.Fatalf("%v anti %v: unexpected violations %d, expected %d", topics, anti, v, expected)
+			}
+		}
+	}
+}
+
+// affinityCost returns the number of violations of the hard rules and the
+// penalty of the soft ones
+func affinityCost(ai *affinityIndex) (int, float64) {
+	var hard int
+	var soft float64
+	for _, counts := range ai.counts {
+		for idx, rule := range ai.rules {
+			v := counts[idx].violations(rule.Anti)
+			if rule.Penalty == 0 {
+				hard += v
+			} else {
+				soft += rule.Penalty * float64(v)
+			}
+		}
+	}
+	return hard, soft
+}
+
+func randomAffinities(rng *rand.Rand, topics int) []AffinityRule {
+	var rules []AffinityRule
+	for i := 1 + rng.Intn(4); i > 0; i-- {
+		rule := AffinityRule{
+			Topic: fmt.Sprintf("topic%d*", rng.Intn(topics)),
+			With:  fmt.Sprintf("topic%d*", rng.Intn(topics)),
+			Anti:  rng.Intn(2) == 0,
+		}
+		if rng.Intn(2) == 0 {
+			rule.Penalty = float64(1 + rng.Intn(4))
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func TestAffinityIndex(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for seed := 0; seed < 20; seed++ {
+		pl := randomCluster(rng, 3+rng.Intn(6), 20+rng.Intn(100))
+		rules := randomAffinities(rng, 10)
+		s := NewState(pl)
+		if _, err := s.affinityIndex(rules); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+
+		for step := 0; step < 100; step++ {
+			ai, _ := s.affinityIndex(rules)
+			expected, _ := newAffinityIndex(s.pl, rules)
+			if !reflect.DeepEqual(ai.counts, expected.counts) || !reflect.DeepEqual(ai.replicas, expected.replicas) {
+				t.Fatalf("seed %d step %d: unexpected index %v, expected %v", seed, step, ai.counts, expected.counts)
+			}
+
+			p := s.pl.Partitions[rng.Intn(len(s.pl.Partitions))]
+			from := p.Replicas[rng.Intn(len(p.Replicas))]
+			to := model.BrokerID(1 + rng.Intn(9))
+			if inBrokerList(p.Replicas, to) {
+				continue
+			}
+			hard, soft := ai.delta(p.Topic, from, to)
+			bhard, bsoft := affinityCost(ai)
+			s.Apply(replacepl(p, from, to))
+			ahard, asoft := affinityCost(ai)
+			if ahard-bhard != hard || asoft-bsoft != soft {
+				t.Fatalf("seed %d step %d: unexpected delta %d %v, expected %d %v", seed, step, hard, soft, ahard-bhard, asoft-bsoft)
+			}
+		}
+	}
+}
+
+func TestBalanceAntiAffinity(t *testing.T) {
+	// b and c are on the brokers of a
+	pl := wrap([]model.Partition{
+		{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+		{Topic: "a", Partition: 2, Replicas: []model.BrokerID{1, 2}},
+		{Topic: "b", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+		{Topic: "c", Partition: 1, Replicas: []model.BrokerID{2, 1}},
+		{Topic: "x", Partition: 1, Replicas: []model.BrokerID{3}, NumReplicas: 1},
+	})
+	cfg := DefaultRebalanceConfig()
+	cfg.Affinities = []AffinityRule{{Topic: "a", With: "[bc]", Anti: true}}
+
+	h, err := GetHealth(pl, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	// all replicas on brokers 1 and 2 violate the rule
+	if len(h.Violations) != 8 {
+		t.Errorf("unexpected violations %v", h.Violations)
+	}
+
+	// the moves never add violations, even if the unbalance stays higher
+	s := NewState(pl)
+	for moves := 0; ; moves++ {
+		if moves == 100 {
+			t.Fatalf("rebalancing did not converge")
+		}
+		ai, err := cfg.affinityIndex(s.pl)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		hard, _ := affinityCost(ai)
+		res, err := New(DefaultSteps()...).BalanceState(context.Background(), s, cfg)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if len(res.Changes.Partitions) == 0 {
+			break
+		}
+		if ai, err = cfg.affinityIndex(s.pl); err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if h, _ := affinityCost(ai); h > hard {
+			t.Fatalf("violations increased from %d to %d by %v", hard, h, res.Changes)
+		}
+	}
+
+	// soft rules are fixed if the penalty outweighs the unbalance
+	pl.Partitions = append(pl.Partitions, model.Partition{Topic: "y", Partition: 1, Replicas: []model.BrokerID{4}, NumReplicas: 1})
+	cfg.Affinities[0].Penalty = 100
+	cfg.AllowLeaderRebalancing = true
+	if h, err := GetHealth(pl, cfg); err != nil || len(h.Violations) != 0 {
+		t.Errorf("unexpected violations %v, error %v", h, err)
+	}
+	s = NewState(pl)
+	for moves := 0; ; moves++ {
+		if moves == 100 {
+			t.Fatalf("rebalancing did not converge")
+		}
+		res, err := New(DefaultSteps()...).BalanceState(context.Background(), s, cfg)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if len(res.Changes.Partitions) == 0 {
+			break
+		}
+	}
+	ai, err := cfg.affinityIndex(s.pl)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if _, soft := affinityCost(ai); soft != 0 {
+		t.Errorf("unexpected penalty %v: %v", soft, s.pl)
+	}
+
+	cfg.Affinities[0].Penalty = -1
+	if _, err := Balance(pl, cfg); err == nil {
+		t.Errorf("expected error")
+	}
+	cfg.Affinities[0] = AffinityRule{Topic: "re:(", With: "a"}
+	if _, err := Balance(pl, cfg); err == nil {
+		t.Errorf("expected error")
+	}
+	// the steps invoked directly don't validate the configuration
+	if _, err := MoveNonLeaders(pl, cfg); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestBalanceAffinity(t *testing.T) {
+	// the replicas of b follow the ones of a
+	pl := wrap([]model.Partition{
+		{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+		{Topic: "b", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+		{Topic: "x", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+		{Topic: "x", Partition: 2, Replicas: []model.BrokerID{1, 2}},
+		{Topic: "y", Partition: 1, Replicas: []model.BrokerID{3, 4}, NumReplicas: 2},
+	})
+	cfg := DefaultRebalanceConfig()
+	cfg.AllowLeaderRebalancing = true
+	cfg.Affinities = []AffinityRule{{Topic: "a", With: "b"}}
+
+	s := NewState(pl)
+	for moves := 0; moves < 100; moves++ {
+		res, err := New(DefaultSteps()...).BalanceState(context.Background(), s, cfg)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if len(res.Changes.Partitions) == 0 {
+			break
+		}
+		for _, p := range res.Changes.Partitions {
+			if p.Topic == "a" || p.Topic == "b" {
+				t.Errorf("unexpected change %v", p)
+			}
+		}
+	}
+
+	// a replica of b added to a new broker violates the rule only if there
+	// is no alternative
+	pl.Partitions[1].NumReplicas = 3
+	pl.Partitions[1].Brokers = []model.BrokerID{1, 2, 3}
+	res, err := Balance(pl, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if res.Step != "AddMissingReplicas" || !reflect.DeepEqual(res.Changes.Partitions[0].Replicas, []model.BrokerID{1, 2, 3}) {
+		t.Errorf("unexpected changes %v", res.Changes)
+	}
+	h, err := GetHealth(res.State, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(h.Violations) != 1 || h.Violations[0].Topic != "b" {
+		t.Errorf("unexpected violations %v", h.Violations)
+	}
+}
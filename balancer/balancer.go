@@ -0,0 +1,287 @@
+// Package balancer computes the reassignments that minimize the workload
+// unbalance between the brokers of a kafka cluster, subject to a set of
+// constraints (allowed brokers, number of replicas, excluded topics, ...).
+//
+// Rebalancing is performed by a pipeline of steps executed in order: each
+// invocation of Balance returns the changes proposed by the first step that
+// proposes any, so Balance is meant to be invoked iteratively, applying the
+// returned changes between invocations. Custom pipelines, including user
+// defined steps, can be built with New.
+//
+// The package has no global state and doesn't log unless a Logger is set in
+// the RebalanceConfig.
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// RebalanceConfig contains the configuration that drives the rebalancing.
+type RebalanceConfig struct {
+	AllowLeaderRebalancing    bool
+	MinReplicasForRebalancing int
+	MinUnbalance              float64
+
+	Brokers []model.BrokerID
+
+	// Include and Exclude are lists of topic patterns (see
+	// CompileTopicPattern). If Include is not empty, partitions of topics not
+	// matching any of its patterns are pinned. Partitions of topics matching any
+	// of the patterns in Exclude are pinned.
+	Include []string
+	Exclude []string
+
+	// Decommission is the list of brokers that have to be drained of all their
+	// replicas, regardless of the allowed brokers of each partition
+	Decommission []model.BrokerID
+	// Racks maps brokers to the rack they are in: when placing replicas, brokers
+	// in racks not already hosting a replica of the same partition are preferred
+	Racks map[model.BrokerID]string
+	// ScaleOut is the list of brokers recently added to the cluster that have
+	// to be filled up to the average broker load
+	ScaleOut []model.BrokerID
+
+	// Parallelism is the maximum number of goroutines evaluating the candidate
+	// moves; if 0, GOMAXPROCS is used. The proposed changes don't
+	// depend on it.
+	Parallelism int
+	// Seed, if not 0, is used to break the ties between candidate moves
+	// yielding the same unbalance: the candidate is picked pseudo-randomly,
+	// depending only on the seed and on the partitions and brokers involved.
+	// If 0, the candidate coming first in the partition list, and then in the
+	// list of brokers by load, is picked.
+	Seed int64
+	// Metric is the name of the metric used to measure the unbalance of the
+	// brokers (see RegisteredMetrics); if empty, DefaultMetric is used.
+	// MinUnbalance is in the units of the metric.
+	Metric string
+	// LoadModel defines the load of the replicas on their brokers; if nil,
+	// DefaultLoadModel is used
+	LoadModel *LoadModel
+	// Affinities are the affinity and anti-affinity rules between topics
+	Affinities []AffinityRule
+	// CoPartitioned are the groups of co-partitioned topics, whose partitions
+	// with the same number are kept aligned
+	CoPartitioned []CoPartitionGroup
+	// MaxMovesFrom and MaxMovesTo, if not 0, are the maximum number of
+	// replicas moved (or removed) from each broker, and moved (or added) to
+	// each broker, by the changes applied to the State being balanced: the
+	// steps skip the candidate changes that would exceed them
+	MaxMovesFrom int
+	MaxMovesTo   int
+
+	// Logger, if not nil, is used to log the changes proposed by each step
+	Logger *log.Logger
+	// Explain enables the generation of an Explanation of the changes
+	// proposed by Balance
+	Explain bool
+
+	candidates *candidateList
+	ctx        context.Context
+	state      *State
+}
+
+// DefaultRebalanceConfig returns the default RebalanceConfig. These values are
+// also the one used as the default values for the CLI flags.
+func DefaultRebalanceConfig() RebalanceConfig {
+	return RebalanceConfig{
+		AllowLeaderRebalancing:    false,
+		MinReplicasForRebalancing: 2,
+		MinUnbalance:              0.00001,
+	}
+}
+
+// Balancer executes an ordered pipeline of steps
+type Balancer struct {
+	steps []Step
+}
+
+// New returns a Balancer executing the specified steps, in order
+func New(steps ...Step) *Balancer {
+	return &Balancer{steps: steps}
+}
+
+// Steps returns the steps executed by the Balancer, in order
+func (b *Balancer) Steps() []Step {
+	return append([]Step(nil), b.steps...)
+}
+
+// Result is the outcome of a Balance invocation
+type Result struct {
+	// Step is the name of the step that proposed the changes, if any
+	Step string
+	// Changes contains the partitions to reassign
+	Changes *model.PartitionList
+	// State is a copy of the partition list passed to Balance, with the
+	// default values filled in and the changes applied
+	State *model.PartitionList
+	// Explanation describes the changes, if RebalanceConfig.Explain is set
+	Explanation *Explanation
+}
+
+// Balance analyzes the workload distribution among brokers for the
+// partitions listed in the argument. It returns 0 or more partition
+// reassignments and the state resulting from applying them. The partition list
+// passed as argument is not modified.
+func (b *Balancer) Balance(pl *model.PartitionList, cfg RebalanceConfig) (*Result, error) {
+	return b.BalanceContext(context.Background(), pl, cfg)
+}
+
+// BalanceContext is like Balance, but it stops as soon as the context is done,
+// returning the error of the context, unless the step running at that time
+// proposes changes anyway: MoveLeaders and MoveNonLeaders propose the best
+// move found so far, if it improves the unbalance
+func (b *Balancer) BalanceContext(ctx context.Context, pl *model.PartitionList, cfg RebalanceConfig) (*Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return b.BalanceState(ctx, NewState(pl), cfg)
+}
+
+// BalanceState is like BalanceContext, but the changes are applied to the
+// State, that is also passed to the steps: when invoked repeatedly on the
+// same State, the work needed at each invocation depends on the changes
+// proposed rather than on the size of the cluster. The State of the Result
+// is the partition list of s.
+func (b *Balancer) BalanceState(ctx context.Context, s *State, cfg RebalanceConfig) (*Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	state := s.PartitionList()
+
+	cfg.ctx = ctx
+	cfg.state = s
+	cfg.candidates = nil
+	if cfg.Explain {
+		cfg.candidates = &candidateList{}
+	}
+
+	for _, step := range b.steps {
+		ppl, err := step.Apply(state, cfg)
+		if cerr := ctx.Err(); cerr != nil && (err != nil || ppl == nil) {
+			return nil, cerr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", step.Name(), err)
+		}
+		if ppl != nil {
+			cfg.logf("%s: %v", step.Name(), ppl)
+			res := &Result{Step: step.Name(), Changes: ppl, State: state}
+			if cfg.Explain {
+				if res.Explanation, err = explain(step.Name(), s, ppl, cfg, cfg.candidates); err != nil {
+					return nil, fmt.Errorf("%s: %s", step.Name(), err)
+				}
+			} else {
+				s.Apply(ppl)
+			}
+			return res, nil
+		}
+	}
+
+	cfg.logf("no candidate changes")
+	return &Result{Changes: emptypl(), State: state}, nil
+}
+
+// Balance is like Balancer.Balance, using the default steps
+func Balance(pl *model.PartitionList, cfg RebalanceConfig) (*Result, error) {
+	return New(DefaultSteps()...).Balance(pl, cfg)
+}
+
+// BalanceContext is like Balancer.BalanceContext, using the default steps
+func BalanceContext(ctx context.Context, pl *model.PartitionList, cfg RebalanceConfig) (*Result, error) {
+	return New(DefaultSteps()...).BalanceContext(ctx, pl, cfg)
+}
+
+// Apply returns a copy of state in which the partitions with the same topic
+// and partition number as the ones in changes are replaced by the latter.
+// Partitions in changes not present in state are appended.
+func Apply(state, changes *model.PartitionList) *model.PartitionList {
+	s := state.Copy()
+
+	idx := make(map[partitionKey]int, len(s.Partitions))
+	for i, p := range s.Partitions {
+		idx[keyOf(p)] = i
+	}
+
+	for _, p := range changes.Copy().Partitions {
+		if i, found := idx[keyOf(p)]; found {
+			s.Partitions[i] = p
+		} else {
+			idx[keyOf(p)] = len(s.Partitions)
+			s.Partitions = append(s.Partitions, p)
+		}
+	}
+
+	return s
+}
+
+// Context returns the context of the current Balance invocation: long running
+// steps should stop as soon as it is done
+func (cfg RebalanceConfig) Context() context.Context {
+	if cfg.ctx == nil {
+		return context.Background()
+	}
+	return cfg.ctx
+}
+
+// parallelism returns the maximum number of goroutines to use
+func (cfg RebalanceConfig) parallelism() int {
+	if cfg.Parallelism > 0 {
+		return cfg.Parallelism
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// validate returns an error if the metric, the load model, the affinity
+// rules, the co-partitioned groups or the move caps are not valid
+func (cfg RebalanceConfig) validate() error {
+	if _, err := LookupMetric(cfg.Metric); err != nil {
+		return err
+	}
+	if cfg.MaxMovesFrom < 0 || cfg.MaxMovesTo < 0 {
+		return fmt.Errorf("invalid maximum moves from %d or to %d each broker", cfg.MaxMovesFrom, cfg.MaxMovesTo)
+	}
+	for _, rule := range cfg.Affinities {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, g := range cfg.CoPartitioned {
+		if err := g.Validate(); err != nil {
+			return err
+		}
+	}
+	return cfg.loadModel().Validate()
+}
+
+// brokerLoad returns the load of the brokers of the partition list, using the
+// indices of the State being balanced if pl is its partition list
+func (cfg RebalanceConfig) brokerLoad(pl *model.PartitionList) map[model.BrokerID]float64 {
+	if cfg.state != nil && cfg.state.pl == pl {
+		return cfg.state.brokerLoad(cfg.loadModel())
+	}
+	return getBrokerLoad(pl, cfg.loadModel())
+}
+
+// brokerList is like getBrokerList, using the indices of the State being
+// balanced if pl is its partition list
+func (cfg RebalanceConfig) brokerList(pl *model.PartitionList) []model.BrokerID {
+	if cfg.state != nil && cfg.state.pl == pl {
+		return cfg.state.brokerList()
+	}
+	return getBrokerList(pl)
+}
+
+func (cfg RebalanceConfig) logf(format string, v ...interface{}) {
+	if cfg.Logger != nil {
+		cfg.Logger.Printf(format, v...)
+	}
+}
@@ -0,0 +1,650 @@
+package balancer
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+type testCase struct {
+	pl  []model.Partition
+	ppl []model.Partition
+	err string
+	cfg *RebalanceConfig
+}
+
+func wrap(p []model.Partition) *model.PartitionList {
+	return &model.PartitionList{
+		Version:    1,
+		Partitions: p,
+	}
+}
+
+func TestBalancing(t *testing.T) {
+	cfgLeader := DefaultRebalanceConfig()
+	cfgLeader.AllowLeaderRebalancing = true
+
+	cfg3Replicas := DefaultRebalanceConfig()
+	cfg3Replicas.MinReplicasForRebalancing = 3
+
+	cfg6Brokers := DefaultRebalanceConfig()
+	cfg6Brokers.Brokers = []model.BrokerID{1, 2, 3, 4, 5, 6}
+
+	cfg6BrokersIrregular := DefaultRebalanceConfig()
+	cfg6BrokersIrregular.Brokers = []model.BrokerID{1, 2, 3, 4, 5, 7}
+
+	cfgExclude := DefaultRebalanceConfig()
+	cfgExclude.Exclude = []string{"a"}
+
+	cfgInclude := cfg6Brokers
+	cfgInclude.Include = []string{"re:^b$"}
+
+	cfgDecommission := DefaultRebalanceConfig()
+	cfgDecommission.Decommission = []model.BrokerID{3}
+
+	cfgRacks := cfg6Brokers
+	cfgRacks.Racks = map[model.BrokerID]string{1: "a", 2: "a", 3: "b", 4: "b", 5: "b", 6: "c"}
+
+	cfgScaleOut := DefaultRebalanceConfig()
+	cfgScaleOut.ScaleOut = []model.BrokerID{4}
+
+	cfgScaleOutLeaders := cfgScaleOut
+	cfgScaleOutLeaders.AllowLeaderRebalancing = true
+
+	tc := []testCase{
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2, 3}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{1, 3, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{1, 4, 5}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{4, 2, 3}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5}},
+			},
+			cfg: &cfgLeader,
+		},
+
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2, 3}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1, 4}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{1, 2, 5}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 3, 4}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5}},
+			},
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2, 3}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 3, 4}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{1, 2, 5}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 4, 3}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5}},
+			},
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 4, 3}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 3, 4}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{1, 2, 5}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{1, 3, 5}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5}},
+			},
+		},
+
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 3}, Weight: 1.0},
+				model.Partition{Topic: "b", Partition: 1, Replicas: []model.BrokerID{4, 3, 2}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "b", Partition: 1, Replicas: []model.BrokerID{4, 3, 1}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4}},
+			},
+			cfg: &cfg3Replicas,
+		},
+
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2, 3}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{1, 2, 3}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 4, 3}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5, 6}},
+			},
+			cfg: &cfg6Brokers,
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 4, 3}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{1, 2, 3}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 4, 5}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5, 6}},
+			},
+			cfg: &cfg6Brokers,
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 4, 5}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{1, 2, 3}, Weight: 1.0},
+			},
+			cfg: &cfg6Brokers,
+		},
+
+		// move from not allowed broker
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 3, 7}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 4, 6}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 3, 5}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5, 6}},
+			},
+			cfg: &cfg6Brokers,
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 3, 5}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 4, 6}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 4, 7}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5, 7}},
+			},
+			cfg: &cfg6BrokersIrregular,
+		},
+
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{2, 1, 6}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1, 6}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{1, 6, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 4, Replicas: []model.BrokerID{1, 6, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 5, Replicas: []model.BrokerID{1, 6, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 6, Replicas: []model.BrokerID{1, 6, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 7, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 8, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 9, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{2, 1, 7}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5, 7}},
+			},
+			cfg: &cfg6BrokersIrregular,
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{2, 1, 7}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1, 6}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{1, 6, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 4, Replicas: []model.BrokerID{1, 6, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 5, Replicas: []model.BrokerID{1, 6, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 6, Replicas: []model.BrokerID{1, 6, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 7, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 8, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 9, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1, 5}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5, 7}},
+			},
+			cfg: &cfg6BrokersIrregular,
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{2, 1, 7}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1, 5}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{1, 6, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 4, Replicas: []model.BrokerID{1, 6, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 5, Replicas: []model.BrokerID{1, 6, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 6, Replicas: []model.BrokerID{1, 6, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 7, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 8, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 9, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{1, 4, 2}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5, 7}},
+			},
+			cfg: &cfg6BrokersIrregular,
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{2, 1, 7}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1, 5}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{1, 4, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 4, Replicas: []model.BrokerID{1, 6, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 5, Replicas: []model.BrokerID{1, 6, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 6, Replicas: []model.BrokerID{1, 6, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 7, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 8, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 9, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 4, Replicas: []model.BrokerID{1, 3, 2}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5, 7}},
+			},
+			cfg: &cfg6BrokersIrregular,
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{2, 1, 7}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1, 5}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{1, 4, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 4, Replicas: []model.BrokerID{1, 3, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 5, Replicas: []model.BrokerID{1, 6, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 6, Replicas: []model.BrokerID{1, 6, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 7, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 8, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 9, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 5, Replicas: []model.BrokerID{1, 3, 2}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5, 7}},
+			},
+			cfg: &cfg6BrokersIrregular,
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{2, 1, 7}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1, 5}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{1, 4, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 4, Replicas: []model.BrokerID{1, 3, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 5, Replicas: []model.BrokerID{1, 3, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 6, Replicas: []model.BrokerID{1, 6, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 7, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 8, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 9, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 6, Replicas: []model.BrokerID{1, 4, 2}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5, 7}},
+			},
+			cfg: &cfg6BrokersIrregular,
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{2, 1, 7}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1, 5}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{1, 4, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 4, Replicas: []model.BrokerID{1, 3, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 5, Replicas: []model.BrokerID{1, 3, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 6, Replicas: []model.BrokerID{1, 4, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 7, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 8, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 9, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 7, Replicas: []model.BrokerID{5, 1, 2}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5, 7}},
+			},
+			cfg: &cfg6BrokersIrregular,
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{2, 1, 7}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1, 5}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{1, 4, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 4, Replicas: []model.BrokerID{1, 3, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 5, Replicas: []model.BrokerID{1, 3, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 6, Replicas: []model.BrokerID{1, 4, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 7, Replicas: []model.BrokerID{5, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 8, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 9, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 8, Replicas: []model.BrokerID{7, 1, 2}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5, 7}},
+			},
+			cfg: &cfg6BrokersIrregular,
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{2, 1, 7}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1, 5}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{1, 4, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 4, Replicas: []model.BrokerID{1, 3, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 5, Replicas: []model.BrokerID{1, 3, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 6, Replicas: []model.BrokerID{1, 4, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 7, Replicas: []model.BrokerID{5, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 8, Replicas: []model.BrokerID{7, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 9, Replicas: []model.BrokerID{6, 1, 2}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 9, Replicas: []model.BrokerID{3, 1, 2}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5, 7}},
+			},
+			cfg: &cfg6BrokersIrregular,
+		},
+
+		// excluded and pinned partitions
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2, 3}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1, 4}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{1, 2, 5}, Weight: 1.0},
+			},
+			cfg: &cfgExclude,
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2, 3}, Weight: 1.0, NumReplicas: 2},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1, 4}, Weight: 1.0},
+				model.Partition{Topic: "b", Partition: 3, Replicas: []model.BrokerID{1, 2, 5}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "b", Partition: 3, Replicas: []model.BrokerID{1, 3, 5}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5}},
+			},
+			cfg: &cfgExclude,
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 3, 7}, Weight: 1.0, Pinned: true},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 4, 8}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 4, 6}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5, 6}},
+			},
+			cfg: &cfg6Brokers,
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 3, 7}, Weight: 1.0},
+				model.Partition{Topic: "b", Partition: 1, Replicas: []model.BrokerID{1, 2, 3}, Weight: 1.0},
+				model.Partition{Topic: "b", Partition: 2, Replicas: []model.BrokerID{1, 2, 3}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "b", Partition: 1, Replicas: []model.BrokerID{1, 2, 4}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5, 6}},
+			},
+			cfg: &cfgInclude,
+		},
+
+		// decommission broker: leaders first, then replicas
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{3, 1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 4, 1}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 3, 2}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 4}},
+			},
+			cfg: &cfgDecommission,
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 3, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 4, 1}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 4, 2}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 4}},
+			},
+			cfg: &cfgDecommission,
+		},
+
+		// rack constraints
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 3, 7}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 4, 6}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 3, 6}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3, 4, 5, 6}},
+			},
+			cfg: &cfgRacks,
+		},
+
+		// scale-out: leaders are moved first, if allowed
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 3}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{3, 1}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 4, Replicas: []model.BrokerID{1, 2}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{4, 2}, Weight: 1.0, NumReplicas: 2, Brokers: []model.BrokerID{1, 2, 3, 4}},
+			},
+			cfg: &cfgScaleOutLeaders,
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 3}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{3, 1}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 4, Replicas: []model.BrokerID{1, 2}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 4}, Weight: 1.0, NumReplicas: 2, Brokers: []model.BrokerID{1, 2, 3, 4}},
+			},
+			cfg: &cfgScaleOut,
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{4, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 3}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{3, 1}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 4, Replicas: []model.BrokerID{1, 2}, Weight: 1.0},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 4, Replicas: []model.BrokerID{1, 4}, Weight: 1.0, NumReplicas: 2, Brokers: []model.BrokerID{1, 2, 3, 4}},
+			},
+			cfg: &cfgScaleOut,
+		},
+
+		// remove extra replica
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2, 3}, Weight: 1.0, NumReplicas: 2},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 3}, Weight: 1.0, NumReplicas: 2, Brokers: []model.BrokerID{1, 2, 3}},
+			},
+		},
+
+		// add missing replica
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3}},
+			},
+			ppl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2, 3}, Weight: 1.0, NumReplicas: 3, Brokers: []model.BrokerID{1, 2, 3}},
+			},
+		},
+
+		// duplicate replicas
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 1}, Weight: 1.0, Brokers: []model.BrokerID{1, 2}},
+			},
+			err: "has duplicated replicas",
+		},
+
+		// all weights missing
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1}},
+			},
+		},
+
+		// one weight missing
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1}},
+			},
+			err: "has no weight",
+		},
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1}, Weight: 1.0},
+			},
+			err: "has no weight",
+		},
+
+		// negative weight
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}, Weight: 1.0},
+				model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1}, Weight: -1.0},
+			},
+			err: "has negative weight",
+		},
+
+		// unable to add replica
+		testCase{
+			pl: []model.Partition{
+				model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}, NumReplicas: 3},
+			},
+			err: "unable to pick replica to add",
+		},
+	}
+
+	for _, c := range tc {
+		pl := wrap(c.pl)
+
+		cfg := DefaultRebalanceConfig()
+		if c.cfg != nil {
+			cfg = *c.cfg
+		}
+
+		opl := pl.Copy()
+		res, err := Balance(pl, cfg)
+		var ppl *model.PartitionList
+		if res != nil {
+			ppl = res.Changes
+		}
+
+		if !reflect.DeepEqual(opl, pl) {
+			t.Errorf("input modified: expected %v, got %v", opl, pl)
+		}
+
+		if c.err != "" {
+			if !strings.Contains(err.Error(), c.err) {
+				t.Errorf("expected error %v, got %v", c.err, err)
+			}
+			if ppl != nil {
+				t.Errorf("expected nil ppl, got %v", ppl)
+			}
+		} else if err != nil {
+			t.Errorf("unexpected error %v", err)
+		} else if !reflect.DeepEqual(wrap(c.ppl), ppl) {
+			t.Errorf("expected %v, got %v", wrap(c.ppl), ppl)
+			t.Logf("pl %v", c.pl)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	state := wrap([]model.Partition{
+		model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+		model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 3}},
+	})
+	changes := wrap([]model.Partition{
+		model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1}},
+		model.Partition{Topic: "b", Partition: 1, Replicas: []model.BrokerID{3}},
+	})
+
+	s := Apply(state, changes)
+
+	expected := wrap([]model.Partition{
+		model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+		model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1}},
+		model.Partition{Topic: "b", Partition: 1, Replicas: []model.BrokerID{3}},
+	})
+	if !reflect.DeepEqual(expected, s) {
+		t.Errorf("expected %v, got %v", expected, s)
+	}
+	if state.Partitions[1].Replicas[1] != 3 || len(state.Partitions) != 2 {
+		t.Errorf("state modified: %v", state)
+	}
+
+	s.Partitions[1].Replicas[0] = 4
+	if changes.Partitions[0].Replicas[0] != 2 {
+		t.Errorf("changes share replicas with the new state: %v", changes)
+	}
+}
+
+func TestBalanceState(t *testing.T) {
+	pl := wrap([]model.Partition{
+		model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2, 3}, NumReplicas: 2},
+		model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{1, 2}},
+	})
+
+	res, err := Balance(pl, DefaultRebalanceConfig())
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if res.Step != "RemoveExtraReplicas" {
+		t.Errorf("unexpected step %s", res.Step)
+	}
+
+	expected := wrap([]model.Partition{
+		model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}, Weight: 1.0, NumReplicas: 2, Brokers: []model.BrokerID{1, 2, 3}},
+		model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{1, 2}, Weight: 1.0, NumReplicas: 2, Brokers: []model.BrokerID{1, 2, 3}},
+	})
+	if !reflect.DeepEqual(expected, res.State) {
+		t.Errorf("expected %v, got %v", expected, res.State)
+	}
+	if !reflect.DeepEqual(pl.Partitions[0].Replicas, []model.BrokerID{1, 2, 3}) || pl.Partitions[0].Weight != 0 {
+		t.Errorf("input modified: %v", pl)
+	}
+}
+
+func TestBalanceContext(t *testing.T) {
+	pl := wrap([]model.Partition{
+		model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+		model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{1, 2}},
+	})
+	cfg := DefaultRebalanceConfig()
+	cfg.Brokers = []model.BrokerID{1, 2, 3}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	res, err := BalanceContext(ctx, pl, cfg)
+	if err != nil || res.Step != "MoveNonLeaders" {
+		t.Fatalf("unexpected result %v, error %v", res, err)
+	}
+
+	cancel()
+	if _, err = BalanceContext(ctx, pl, cfg); err != context.Canceled {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	// steps see the context: cancel it while the pipeline is running
+	ctx, cancel = context.WithCancel(context.Background())
+	steps := append([]Step{NewStep("Cancel", func(*model.PartitionList, RebalanceConfig) (*model.PartitionList, error) {
+		cancel()
+		return nil, nil
+	})}, DefaultSteps()...)
+	if _, err = New(steps...).BalanceContext(ctx, pl, cfg); err != context.Canceled {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	r, err := New(DefaultSteps()...).Report(ctx, pl, cfg, 0)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if r.Converged || r.MovesNeeded != 0 || len(r.Brokers) != 3 {
+		t.Errorf("unexpected report %v", r)
+	}
+
+	// the best move found before the context is done is still proposed: the
+	// metric cancels it when the unbalance of the first candidate is computed
+	ctx, cancel = context.WithCancel(context.Background())
+	calls := 0
+	RegisterMetric("test-cancel", func(loads []float64) float64 {
+		if calls++; calls == 2 {
+			cancel()
+		}
+		return squaresMetric(loads)
+	})
+	cfg.Metric = "test-cancel"
+	res, err = BalanceContext(ctx, pl, cfg)
+	if err != nil || res.Step != "MoveNonLeaders" || len(res.Changes.Partitions) != 1 {
+		t.Fatalf("unexpected result %v, error %v", res, err)
+	}
+	if p := res.Changes.Partitions[0]; p.Partition != 1 || !reflect.DeepEqual(p.Replicas, []model.BrokerID{1, 3}) {
+		t.Errorf("unexpected changes %v", res.Changes)
+	}
+	if ctx.Err() == nil {
+		t.Errorf("context not canceled")
+	}
+}
@@ -0,0 +1,49 @@
+package balancer
+
+import (
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// countMoves adds to from and to the brokers the replicas of a partition are
+// moved from and to when they change from old to replicas
+func countMoves(old, replicas []model.BrokerID, from, to map[model.BrokerID]int) {
+	for _, r := range old {
+		if !inBrokerList(replicas, r) {
+			from[r]++
+		}
+	}
+	for _, r := range replicas {
+		if !inBrokerList(old, r) {
+			to[r]++
+		}
+	}
+}
+
+// capped reports whether moving n more replicas from broker from to broker to
+// would exceed MaxMovesFrom or MaxMovesTo, counting the moves already applied
+// to the State being balanced. If from (or to) is -1 the replicas are only
+// added (or removed).
+func (cfg RebalanceConfig) capped(from, to model.BrokerID, n int) bool {
+	if cfg.state == nil {
+		return false
+	}
+	if from != -1 && cfg.MaxMovesFrom > 0 && cfg.state.movesFrom[from]+n > cfg.MaxMovesFrom {
+		return true
+	}
+	return to != -1 && cfg.MaxMovesTo > 0 && cfg.state.movesTo[to]+n > cfg.MaxMovesTo
+}
+
+// cappedMoves is like capped, for the moves counted in from and to
+func (cfg RebalanceConfig) cappedMoves(from, to map[model.BrokerID]int) bool {
+	for b, n := range from {
+		if cfg.capped(b, -1, n) {
+			return true
+		}
+	}
+	for b, n := range to {
+		if cfg.capped(-1, b, n) {
+			return true
+		}
+	}
+	return false
+}
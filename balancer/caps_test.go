@@ -0,0 +1,134 @@
+package balancer
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+func TestBalanceMaxMoves(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	skipped := false
+	for seed := 0; seed < 20; seed++ {
+		pl := randomCluster(rng, 3+rng.Intn(6), 20+rng.Intn(100))
+		cfg := DefaultRebalanceConfig()
+		cfg.AllowLeaderRebalancing = rng.Intn(2) == 0
+		cfg.MaxMovesFrom = 1 + rng.Intn(3)
+		cfg.MaxMovesTo = 1 + rng.Intn(3)
+
+		s := NewState(pl)
+		replicas := make(map[partitionKey][]model.BrokerID)
+		for _, p := range pl.Partitions {
+			replicas[keyOf(p)] = p.Replicas
+		}
+		from, to := make(map[model.BrokerID]int), make(map[model.BrokerID]int)
+		capped := false
+		for moves := 0; ; moves++ {
+			if moves == 1000 {
+				t.Fatalf("seed %d: rebalancing did not converge", seed)
+			}
+			res, err := New(DefaultSteps()...).BalanceState(context.Background(), s, cfg)
+			if err != nil {
+				t.Fatalf("seed %d: unexpected error %s", seed, err)
+			}
+			if len(res.Changes.Partitions) == 0 {
+				break
+			}
+			// the balancer goes on after the first broker reaches its cap
+			skipped = skipped || capped
+			for _, p := range res.Changes.Partitions {
+				countMoves(replicas[keyOf(p)], p.Replicas, from, to)
+				replicas[keyOf(p)] = p.Replicas
+			}
+			for _, caps := range []struct {
+				moves map[model.BrokerID]int
+				max   int
+			}{{from, cfg.MaxMovesFrom}, {to, cfg.MaxMovesTo}} {
+				for b, n := range caps.moves {
+					if n > caps.max {
+						t.Fatalf("seed %d: broker %d exceeds the caps: %d moves from, %d to", seed, b, from[b], to[b])
+					}
+					capped = capped || n == caps.max
+				}
+			}
+		}
+	}
+	if !skipped {
+		t.Errorf("the balancer never went on after a broker reached its cap")
+	}
+}
+
+func TestBalanceMaxMovesDecommission(t *testing.T) {
+	pl := wrap([]model.Partition{
+		{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 3}},
+		{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 3}},
+		{Topic: "a", Partition: 3, Replicas: []model.BrokerID{3, 1}},
+		{Topic: "b", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+		{Topic: "b", Partition: 2, Replicas: []model.BrokerID{1, 2}},
+		{Topic: "b", Partition: 3, Replicas: []model.BrokerID{1, 2}},
+	})
+	cfg := DefaultRebalanceConfig()
+	cfg.Brokers = []model.BrokerID{1, 2, 3, 4}
+	cfg.Decommission = []model.BrokerID{3}
+	cfg.MaxMovesFrom = 1
+
+	// only one replica is moved away from broker 3, and the other brokers
+	// keep being balanced
+	s := NewState(pl)
+	var steps []string
+	for moves := 0; ; moves++ {
+		if moves == 100 {
+			t.Fatalf("rebalancing did not converge")
+		}
+		res, err := New(DefaultSteps()...).BalanceState(context.Background(), s, cfg)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if len(res.Changes.Partitions) == 0 {
+			break
+		}
+		steps = append(steps, res.Step)
+	}
+	disallowed := 0
+	for _, step := range steps {
+		if step == "MoveDisallowedReplicas" {
+			disallowed++
+		}
+	}
+	if disallowed != 1 || steps[len(steps)-1] == "MoveDisallowedReplicas" {
+		t.Errorf("unexpected steps %v", steps)
+	}
+	for b, n := range s.movesFrom {
+		if n > 1 {
+			t.Errorf("%d replicas moved from broker %d", n, b)
+		}
+	}
+	h, err := GetHealth(s.PartitionList(), cfg)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(h.Violations) != 2 {
+		t.Errorf("unexpected violations %v", h.Violations)
+	}
+
+	// the moves needed to fix the violations don't depend on the caps
+	r, err := New(DefaultSteps()...).Report(context.Background(), pl, cfg, 0)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	cfg.MaxMovesFrom = 0
+	expected, err := New(DefaultSteps()...).Report(context.Background(), pl, cfg, 0)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if r.MovesNeeded != expected.MovesNeeded || !r.Converged {
+		t.Errorf("unexpected moves needed %d, expected %d", r.MovesNeeded, expected.MovesNeeded)
+	}
+
+	cfg.MaxMovesTo = -1
+	if _, err := Balance(pl, cfg); err == nil {
+		t.Errorf("expected error")
+	}
+}
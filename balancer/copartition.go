@@ -0,0 +1,334 @@
+package balancer
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// CoPartitionGroup is a group of co-partitioned topics, matching any of the
+// Topics patterns (see CompileTopicPattern): the partitions of the topics of
+// the group with the same partition number are kept on the same replicas, in
+// the same order, or only with the same leader if LeaderOnly is set (or if
+// they have a different number of replicas). The first topic of the group, in
+// name order, having a partition with a given number is the one the others
+// are aligned to.
+type CoPartitionGroup struct {
+	Topics     []string `json:"topics"`
+	LeaderOnly bool     `json:"leader_only,omitempty"`
+}
+
+// Validate returns an error if the group has no topic patterns or they are
+// not valid
+func (g CoPartitionGroup) Validate() error {
+	if len(g.Topics) == 0 {
+		return fmt.Errorf("co-partitioned group %+v has no topics", g)
+	}
+	if _, err := compileTopicPatterns(g.Topics); err != nil {
+		return fmt.Errorf("co-partitioned group %+v: %s", g, err)
+	}
+
+	return nil
+}
+
+// coPartitionUnit are the partitions with the same number of the topics of a
+// co-partitioned group
+type coPartitionUnit struct {
+	leaderOnly bool
+	// the positions of the partitions in the partition list, the one the
+	// others are aligned to first
+	members []int
+}
+
+// coPartitionIndex maps the partitions of co-partitioned topics to their unit
+type coPartitionIndex struct {
+	pl    *model.PartitionList
+	units map[partitionKey]*coPartitionUnit
+}
+
+func newCoPartitionIndex(pl *model.PartitionList, groups []CoPartitionGroup) (*coPartitionIndex, error) {
+	matchers := make([][]TopicMatcher, 0, len(groups))
+	for _, g := range groups {
+		if err := g.Validate(); err != nil {
+			return nil, err
+		}
+		m, _ := compileTopicPatterns(g.Topics)
+		matchers = append(matchers, m)
+	}
+
+	type unitKey struct {
+		group     int
+		partition model.PartitionID
+	}
+	units := make(map[unitKey]*coPartitionUnit)
+	topicGroup := make(map[model.TopicName]int)
+	for i, p := range pl.Partitions {
+		g, found := topicGroup[p.Topic]
+		if !found {
+			g = -1
+			for idx, m := range matchers {
+				if matchTopic(m, p.Topic) {
+					g = idx
+					break
+				}
+			}
+			topicGroup[p.Topic] = g
+		}
+		if g == -1 {
+			continue
+		}
+
+		k := unitKey{g, p.Partition}
+		u := units[k]
+		if u == nil {
+			u = &coPartitionUnit{leaderOnly: groups[g].LeaderOnly}
+			units[k] = u
+		}
+		u.members = append(u.members, i)
+	}
+
+	ci := &coPartitionIndex{pl: pl, units: make(map[partitionKey]*coPartitionUnit)}
+	for _, u := range units {
+		if len(u.members) < 2 {
+			continue
+		}
+		sort.Slice(u.members, func(i, j int) bool {
+			return pl.Partitions[u.members[i]].Topic < pl.Partitions[u.members[j]].Topic
+		})
+		for _, i := range u.members {
+			ci.units[keyOf(pl.Partitions[i])] = u
+		}
+	}
+
+	return ci, nil
+}
+
+// coPartitionIndex returns the coPartitionIndex of the partition list, using
+// the one of the State being balanced if pl is its partition list, or nil if
+// there are no co-partitioned groups
+func (cfg RebalanceConfig) coPartitionIndex(pl *model.PartitionList) (*coPartitionIndex, error) {
+	if len(cfg.CoPartitioned) == 0 {
+		return nil, nil
+	}
+	if cfg.state != nil && cfg.state.pl == pl {
+		return cfg.state.coPartitionIndex(cfg.CoPartitioned)
+	}
+	return newCoPartitionIndex(pl, cfg.CoPartitioned)
+}
+
+// unit returns the unit of the partition, or nil if it belongs to none. It
+// can be invoked on a nil index.
+func (ci *coPartitionIndex) unit(p model.Partition) *coPartitionUnit {
+	if ci == nil {
+		return nil
+	}
+	return ci.units[keyOf(p)]
+}
+
+// alignment returns the replicas that align p to ref, or nil if p is already
+// aligned or it can't be aligned as the brokers needed are not allowed or
+// placing it on them would violate the hard affinity rules or add rack
+// conflicts. If p can't be placed on the same replicas, only its leader is
+// aligned.
+func alignment(ref, p model.Partition, leaderOnly bool, racks map[model.BrokerID]string, ai *affinityIndex) []model.BrokerID {
+	if len(ref.Replicas) == 0 || len(p.Replicas) == 0 {
+		return nil
+	}
+
+	if !leaderOnly && len(ref.Replicas) == len(p.Replicas) {
+		aligned, allowed := true, true
+		for idx, r := range ref.Replicas {
+			aligned = aligned && p.Replicas[idx] == r
+			allowed = allowed && inBrokerList(p.Brokers, r)
+		}
+		if aligned {
+			return nil
+		}
+		if allowed && placeable(p, ref.Replicas, racks, ai) {
+			return append([]model.BrokerID(nil), ref.Replicas...)
+		}
+	}
+
+	leader := ref.Replicas[0]
+	if p.Replicas[0] == leader || !inBrokerList(p.Brokers, leader) {
+		return nil
+	}
+	if inBrokerList(p.Replicas, leader) {
+		return leaderpl(p, leader).Partitions[0].Replicas
+	}
+	replicas := replacepl(p, p.Replicas[0], leader).Partitions[0].Replicas
+	if !placeable(p, replicas, racks, ai) {
+		return nil
+	}
+	return replicas
+}
+
+// placeable reports whether moving the replicas of p to replicas doesn't
+// increase the violations of the hard affinity rules and the replicas in the
+// same rack
+func placeable(p model.Partition, replicas []model.BrokerID, racks map[model.BrokerID]string, ai *affinityIndex) bool {
+	hard := 0
+	for _, r := range p.Replicas {
+		if !inBrokerList(replicas, r) {
+			a, _ := ai.delta(p.Topic, r, -1)
+			hard += a
+		}
+	}
+	for _, r := range replicas {
+		if !inBrokerList(p.Replicas, r) {
+			a, _ := ai.delta(p.Topic, -1, r)
+			hard += a
+		}
+	}
+	if hard > 0 {
+		return false
+	}
+
+	return racks == nil || sameRack(replicas, racks) <= sameRack(p.Replicas, racks)
+}
+
+// sameRack returns the number of replicas in the same rack as a previous one
+func sameRack(replicas []model.BrokerID, racks map[model.BrokerID]string) int {
+	n := 0
+	for idx, r := range replicas {
+		if rackConflicts(model.Partition{Replicas: replicas[:idx]}, racks, -1, r) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// aligned reports whether the partitions of the unit are aligned to the first
+// one
+func (u *coPartitionUnit) aligned(pl *model.PartitionList) bool {
+	ref := pl.Partitions[u.members[0]]
+	for _, i := range u.members[1:] {
+		p := pl.Partitions[i]
+		if len(ref.Replicas) == 0 || len(p.Replicas) == 0 || ref.Replicas[0] != p.Replicas[0] {
+			return false
+		}
+		if !u.leaderOnly && len(ref.Replicas) == len(p.Replicas) {
+			for idx, r := range ref.Replicas {
+				if p.Replicas[idx] != r {
+					return false
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+// comoved returns the partitions whose replica on the same broker has to be
+// moved together with the one of p, or nil if p is moved alone. If moved is
+// false, the replica of p can not be moved at all, as it is moved together
+// with the one of the first partition of its unit or with pinned
+// partitions. Non-leader replicas are moved together only if the partitions
+// have the same replicas.
+func (ci *coPartitionIndex) comoved(p model.Partition, leader bool) (partitions []model.Partition, moved bool) {
+	u := ci.unit(p)
+	if u == nil || u.leaderOnly && !leader || !u.aligned(ci.pl) {
+		return nil, true
+	}
+	ref := ci.pl.Partitions[u.members[0]]
+	if !leader && len(ref.Replicas) != len(p.Replicas) {
+		return nil, true
+	}
+	if keyOf(ref) != keyOf(p) {
+		return nil, false
+	}
+
+	for _, i := range u.members[1:] {
+		m := ci.pl.Partitions[i]
+		if !leader && len(m.Replicas) != len(p.Replicas) {
+			continue
+		}
+		if m.Pinned {
+			return nil, false
+		}
+		partitions = append(partitions, m)
+	}
+
+	return partitions, true
+}
+
+// comovedRacks reports whether moving the replicas of the partitions from
+// broker from to broker to adds no rack conflicts
+func comovedRacks(partitions []model.Partition, racks map[model.BrokerID]string, from, to model.BrokerID) bool {
+	for _, p := range partitions {
+		if rackConflicts(p, racks, from, to) > rackConflicts(p, racks, from, from) {
+			return false
+		}
+	}
+	return true
+}
+
+// violations returns the partitions not aligned to the first partition of
+// their unit
+func (ci *coPartitionIndex) violations() []Violation {
+	var v []Violation
+	for _, p := range ci.pl.Partitions {
+		u := ci.unit(p)
+		if u == nil || u.aligned(ci.pl) {
+			continue
+		}
+		ref := ci.pl.Partitions[u.members[0]]
+		if keyOf(ref) == keyOf(p) {
+			continue
+		}
+		if len(ref.Replicas) == 0 || len(p.Replicas) == 0 || ref.Replicas[0] != p.Replicas[0] {
+			v = append(v, Violation{p.Topic, p.Partition, fmt.Sprintf("leader not aligned to the one of %s partition %d", ref.Topic, ref.Partition)})
+		} else {
+			v = append(v, Violation{p.Topic, p.Partition, fmt.Sprintf("replicas not aligned to the ones of %s partition %d", ref.Topic, ref.Partition)})
+		}
+	}
+
+	return v
+}
+
+// AlignCoPartitioned aligns the partitions of the co-partitioned topics with
+// the same number to the first one, as defined by the CoPartitionGroup they
+// belong to. The changes needed to align all the partitions with the same
+// number are proposed together, unless they exceed MaxMovesFrom or
+// MaxMovesTo. Partitions are never moved to brokers violating the hard
+// affinity rules or adding rack conflicts.
+func AlignCoPartitioned(pl *model.PartitionList, cfg RebalanceConfig) (*model.PartitionList, error) {
+	ci, err := cfg.coPartitionIndex(pl)
+	if ci == nil || err != nil {
+		return nil, err
+	}
+	ai, err := cfg.affinityIndex(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range pl.Partitions {
+		u := ci.unit(p)
+		if u == nil || keyOf(pl.Partitions[u.members[0]]) != keyOf(p) {
+			continue
+		}
+
+		changes := emptypl()
+		var from, to map[model.BrokerID]int
+		for _, i := range u.members[1:] {
+			m := pl.Partitions[i]
+			if m.Pinned {
+				continue
+			}
+			if replicas := alignment(p, m, u.leaderOnly, cfg.Racks, ai); replicas != nil {
+				if from == nil {
+					from, to = make(map[model.BrokerID]int), make(map[model.BrokerID]int)
+				}
+				countMoves(m.Replicas, replicas, from, to)
+				m.Replicas = replicas
+				changes.Partitions = append(changes.Partitions, m)
+			}
+		}
+		if len(changes.Partitions) > 0 && !cfg.cappedMoves(from, to) {
+			return changes, nil
+		}
+	}
+
+	return nil, nil
+}
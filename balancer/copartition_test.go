@@ -0,0 +1,273 @@
+package balancer
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// alignedUnits returns the keys of the partitions of the aligned units
+func alignedUnits(t *testing.T, pl *model.PartitionList, cfg RebalanceConfig) map[partitionKey]bool {
+	aligned := make(map[partitionKey]bool)
+	ci, err := cfg.coPartitionIndex(pl)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	for _, p := range pl.Partitions {
+		if u := ci.unit(p); u != nil && u.aligned(pl) {
+			aligned[keyOf(p)] = true
+		}
+	}
+	return aligned
+}
+
+func TestCoPartitionIndex(t *testing.T) {
+	pl := wrap([]model.Partition{
+		{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+		{Topic: "b", Partition: 1, Replicas: []model.BrokerID{2, 3}},
+		{Topic: "c", Partition: 1, Replicas: []model.BrokerID{3, 1}},
+	})
+	groups := []CoPartitionGroup{{Topics: []string{"a", "b"}}}
+	s := NewState(pl)
+	ci, err := s.coPartitionIndex(groups)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	// the index is reused as long as the partitions and the groups don't
+	// change, even if their replicas do
+	s.Apply(wrap([]model.Partition{{Topic: "b", Partition: 1, Replicas: []model.BrokerID{1, 2}}}))
+	if cached, _ := s.coPartitionIndex(groups); cached != ci {
+		t.Errorf("index rebuilt")
+	}
+	if u := ci.unit(s.pl.Partitions[1]); u == nil || !u.aligned(s.pl) {
+		t.Errorf("unexpected unit %v", u)
+	}
+
+	groups[0].Topics[1] = "c"
+	if ci, _ = s.coPartitionIndex(groups); ci.unit(s.pl.Partitions[1]) != nil || ci.unit(s.pl.Partitions[2]) == nil {
+		t.Errorf("index not rebuilt after the groups changed")
+	}
+	s.Apply(wrap([]model.Partition{{Topic: "a", Partition: 2, Replicas: []model.BrokerID{1, 2}}, {Topic: "c", Partition: 2, Replicas: []model.BrokerID{1, 2}}}))
+	if ci, _ = s.coPartitionIndex(groups); ci.unit(s.pl.Partitions[4]) == nil {
+		t.Errorf("index not rebuilt after partitions were appended")
+	}
+}
+
+func TestBalanceCoPartitioned(t *testing.T) {
+	pl := wrap([]model.Partition{
+		{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+		{Topic: "a", Partition: 2, Replicas: []model.BrokerID{1, 2}},
+		{Topic: "b", Partition: 1, Replicas: []model.BrokerID{2, 3}},
+		{Topic: "b", Partition: 2, Replicas: []model.BrokerID{2, 1}},
+		{Topic: "b", Partition: 3, Replicas: []model.BrokerID{1, 2}},
+		{Topic: "x", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+		{Topic: "x", Partition: 2, Replicas: []model.BrokerID{1, 3}},
+	})
+	cfg := DefaultRebalanceConfig()
+	cfg.AllowLeaderRebalancing = true
+	cfg.CoPartitioned = []CoPartitionGroup{{Topics: []string{"a", "b"}}}
+
+	h, err := GetHealth(pl, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	expected := []Violation{
+		{"b", 1, "leader not aligned to the one of a partition 1"},
+		{"b", 2, "leader not aligned to the one of a partition 2"},
+	}
+	if !reflect.DeepEqual(h.Violations, expected) {
+		t.Errorf("unexpected violations %v", h.Violations)
+	}
+
+	// the partitions of b are aligned to the ones of a, and then moved
+	// together with them
+	res, err := Balance(pl, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if res.Step != "AlignCoPartitioned" || len(res.Changes.Partitions) != 1 || !reflect.DeepEqual(res.Changes.Partitions[0].Replicas, []model.BrokerID{1, 2}) {
+		t.Errorf("unexpected changes %s %v", res.Step, res.Changes)
+	}
+
+	// leader moves can be proposed back and forth (see
+	// TestMoveLeadersOscillates): the moves are checked up to the bound of
+	// the ones planned by Report
+	s := NewState(pl)
+	for moves := 0; moves < DefaultMaxMoves(pl); moves++ {
+		res, err := New(DefaultSteps()...).BalanceState(context.Background(), s, cfg)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if len(res.Changes.Partitions) == 0 {
+			break
+		}
+		if res.Step == "MoveLeaders" || res.Step == "MoveNonLeaders" {
+			// b partition 3 has no partition of a to be aligned to
+			changed := make(map[partitionKey]bool)
+			for _, p := range res.Changes.Partitions {
+				changed[keyOf(p)] = true
+			}
+			for n := model.PartitionID(1); n <= 2; n++ {
+				if changed[partitionKey{"a", n}] != changed[partitionKey{"b", n}] {
+					t.Errorf("unexpected changes %v", res.Changes)
+				}
+			}
+		}
+	}
+	if h, err := GetHealth(s.PartitionList(), cfg); err != nil || len(h.Violations) != 0 {
+		t.Errorf("unexpected violations %v, error %v", h, err)
+	}
+
+	// only the leaders are aligned if the partitions have a different number
+	// of replicas, or if LeaderOnly is set
+	pl.Partitions[2].NumReplicas = 3
+	pl.Partitions[2].Replicas = []model.BrokerID{2, 3, 1}
+	res, err = Balance(pl, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if res.Step != "AlignCoPartitioned" || len(res.Changes.Partitions) != 1 || !reflect.DeepEqual(res.Changes.Partitions[0].Replicas, []model.BrokerID{1, 2, 3}) {
+		t.Errorf("unexpected changes %s %v", res.Step, res.Changes)
+	}
+	pl.Partitions[2].NumReplicas = 0
+	pl.Partitions[2].Replicas = []model.BrokerID{2, 3}
+	cfg.CoPartitioned[0].LeaderOnly = true
+	res, err = Balance(pl, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if res.Step != "AlignCoPartitioned" || len(res.Changes.Partitions) != 1 || !reflect.DeepEqual(res.Changes.Partitions[0].Replicas, []model.BrokerID{1, 3}) {
+		t.Errorf("unexpected changes %s %v", res.Step, res.Changes)
+	}
+
+	// partitions are not aligned to disallowed brokers
+	cfg.CoPartitioned[0].LeaderOnly = false
+	pl.Partitions[2].Brokers = []model.BrokerID{2, 3}
+	pl.Partitions[3].Pinned = true
+	res, err = Balance(pl, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if res.Step == "AlignCoPartitioned" {
+		t.Errorf("unexpected changes %v", res.Changes)
+	}
+
+	cfg.CoPartitioned[0].Topics = nil
+	if _, err := Balance(pl, cfg); err == nil {
+		t.Errorf("expected error")
+	}
+	cfg.CoPartitioned[0].Topics = []string{"re:("}
+	if _, err := Balance(pl, cfg); err == nil {
+		t.Errorf("expected error")
+	}
+	// the steps invoked directly don't validate the configuration
+	if _, err := AlignCoPartitioned(pl, cfg); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestBalanceCoPartitionedRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for seed := 0; seed < 20; seed++ {
+		pl := randomCluster(rng, 3+rng.Intn(6), 20+rng.Intn(100))
+		for idx := range pl.Partitions {
+			pl.Partitions[idx].Brokers = nil
+		}
+		cfg := DefaultRebalanceConfig()
+		cfg.AllowLeaderRebalancing = rng.Intn(2) == 0
+		var topics []string
+		for _, p := range pl.Partitions {
+			if p.Partition == 0 && rng.Intn(2) == 0 {
+				topics = append(topics, string(p.Topic))
+			}
+		}
+		for len(topics) > 1 {
+			n := 2 + rng.Intn(len(topics)-1)
+			cfg.CoPartitioned = append(cfg.CoPartitioned, CoPartitionGroup{Topics: topics[:n], LeaderOnly: rng.Intn(2) == 0})
+			topics = topics[n:]
+		}
+
+		s := NewState(pl)
+		for moves := 0; ; moves++ {
+			if moves == DefaultMaxMoves(pl) {
+				if cfg.AllowLeaderRebalancing {
+					// see TestMoveLeadersOscillates
+					break
+				}
+				t.Fatalf("seed %d: rebalancing did not converge", seed)
+			}
+			aligned := alignedUnits(t, s.PartitionList(), cfg)
+			res, err := New(DefaultSteps()...).BalanceState(context.Background(), s, cfg)
+			if err != nil {
+				t.Fatalf("seed %d: unexpected error %s", seed, err)
+			}
+			if len(res.Changes.Partitions) == 0 {
+				break
+			}
+			after := alignedUnits(t, s.PartitionList(), cfg)
+			for k := range aligned {
+				if !after[k] {
+					t.Fatalf("seed %d: %s changes %v misaligned %v", seed, res.Step, res.Changes, k)
+				}
+			}
+		}
+
+		if h, err := GetHealth(s.PartitionList(), cfg); err != nil || len(h.Violations) != 0 {
+			t.Fatalf("seed %d: unexpected violations %v, error %v", seed, h, err)
+		}
+	}
+}
+
+func TestAlignCoPartitionedPlacement(t *testing.T) {
+	// b can't be placed on the brokers of a, as c is on broker 2: only its
+	// leader is moved to broker 1
+	pl := wrap([]model.Partition{
+		{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+		{Topic: "b", Partition: 1, Replicas: []model.BrokerID{3, 4}},
+		{Topic: "c", Partition: 1, Replicas: []model.BrokerID{2, 5}},
+	})
+	cfg := DefaultRebalanceConfig()
+	cfg.CoPartitioned = []CoPartitionGroup{{Topics: []string{"a", "b"}}}
+	cfg.Affinities = []AffinityRule{{Topic: "b", With: "c", Anti: true}}
+	res, err := Balance(pl, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if res.Step != "AlignCoPartitioned" || len(res.Changes.Partitions) != 1 || !reflect.DeepEqual(res.Changes.Partitions[0].Replicas, []model.BrokerID{1, 4}) {
+		t.Errorf("unexpected changes %s %v", res.Step, res.Changes)
+	}
+	// not even the leader, if c is also on broker 1
+	pl.Partitions[2].Replicas = []model.BrokerID{2, 1}
+	res, err = Balance(pl, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if res.Step == "AlignCoPartitioned" {
+		t.Errorf("unexpected changes %v", res.Changes)
+	}
+
+	// the brokers of a are in the same rack
+	pl.Partitions[2].Replicas = []model.BrokerID{3, 4}
+	cfg.Affinities = nil
+	cfg.Racks = map[model.BrokerID]string{1: "r1", 2: "r1", 3: "r2", 4: "r3", 5: "r3"}
+	res, err = Balance(pl, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if res.Step != "AlignCoPartitioned" || len(res.Changes.Partitions) != 1 || !reflect.DeepEqual(res.Changes.Partitions[0].Replicas, []model.BrokerID{1, 4}) {
+		t.Errorf("unexpected changes %s %v", res.Step, res.Changes)
+	}
+	// not even the leader, if it would share the rack of the follower
+	cfg.Racks[4] = "r1"
+	res, err = Balance(pl, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if res.Step == "AlignCoPartitioned" {
+		t.Errorf("unexpected changes %v", res.Changes)
+	}
+}
@@ -0,0 +1,42 @@
+package balancer
+
+import "github.com/cafxx/kafkabalancer/model"
+
+// DecommissionEstimate estimates the work required to drain a set of brokers
+type DecommissionEstimate struct {
+	Replicas int   // number of replicas to move
+	Leaders  int   // number of leaderships to move to a follower first
+	Bytes    int64 // number of bytes to copy to the remaining brokers
+}
+
+// GetDecommissionEstimate estimates the work required to drain the specified
+// brokers of all the replicas in pl
+func GetDecommissionEstimate(pl *model.PartitionList, brokers []model.BrokerID) DecommissionEstimate {
+	var de DecommissionEstimate
+
+	for _, p := range pl.Partitions {
+		for idx, r := range p.Replicas {
+			if !inBrokerList(brokers, r) {
+				continue
+			}
+			de.Replicas++
+			de.Bytes += p.Size
+			if idx == 0 && len(p.Replicas) > 1 {
+				de.Leaders++
+			}
+		}
+	}
+
+	return de
+}
+
+// Batches returns the number of batches of at most maxReassign reassignments
+// required to complete the decommissioning
+func (de DecommissionEstimate) Batches(maxReassign int) int {
+	if maxReassign <= 0 {
+		return 0
+	}
+
+	changes := de.Replicas + de.Leaders
+	return (changes + maxReassign - 1) / maxReassign
+}
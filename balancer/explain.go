@@ -0,0 +1,140 @@
+package balancer
+
+import (
+	"sort"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// maximum number of candidates recorded in an Explanation
+const explainCandidates = 5
+
+// Explanation describes the changes proposed by a step and their effect on
+// the load of the brokers
+type Explanation struct {
+	Step            string             `json:"step"`
+	Original        []model.Partition  `json:"original"`
+	Changes         []model.Partition  `json:"changes"`
+	UnbalanceBefore float64            `json:"unbalance_before"`
+	UnbalanceAfter  float64            `json:"unbalance_after"`
+	Brokers         []BrokerLoadChange `json:"brokers"`
+	// Candidates are the best moves considered by the step, in order from the
+	// best to the worst; the one proposed is marked as Chosen (it is not
+	// necessarily the first, as ties are broken by the Seed, if set). Only the
+	// MoveLeaders and MoveNonLeaders steps record their candidates.
+	Candidates []Candidate `json:"candidates,omitempty"`
+}
+
+// BrokerLoadChange is the load of a broker before and after a change
+type BrokerLoadChange struct {
+	ID     model.BrokerID `json:"id"`
+	Before float64        `json:"before"`
+	After  float64        `json:"after"`
+}
+
+// Candidate is a move of a replica of a partition from a broker to another,
+// and the unbalance resulting from it
+type Candidate struct {
+	Topic     model.TopicName   `json:"topic"`
+	Partition model.PartitionID `json:"partition"`
+	From      model.BrokerID    `json:"from"`
+	To        model.BrokerID    `json:"to"`
+	Unbalance float64           `json:"unbalance"`
+	Chosen    bool              `json:"chosen,omitempty"`
+}
+
+type candidateList struct {
+	candidates []Candidate
+}
+
+func (cl *candidateList) reset() {
+	cl.candidates = cl.candidates[:0]
+}
+
+// add records the candidate if it is among the best ones: candidates with the
+// same unbalance are kept in the order they were added
+func (cl *candidateList) add(c Candidate) {
+	idx := sort.Search(len(cl.candidates), func(i int) bool {
+		return cl.candidates[i].Unbalance > c.Unbalance
+	})
+	if idx >= explainCandidates {
+		return
+	}
+
+	cl.candidates = append(cl.candidates, Candidate{})
+	copy(cl.candidates[idx+1:], cl.candidates[idx:])
+	cl.candidates[idx] = c
+	if len(cl.candidates) > explainCandidates {
+		cl.candidates = cl.candidates[:explainCandidates]
+	}
+}
+
+// choose marks the candidate as the one proposed, recording it if it is not
+// among the best ones
+func (cl *candidateList) choose(c Candidate) {
+	for idx, o := range cl.candidates {
+		if o.Topic == c.Topic && o.Partition == c.Partition && o.From == c.From && o.To == c.To {
+			cl.candidates[idx].Chosen = true
+			return
+		}
+	}
+
+	if len(cl.candidates) >= explainCandidates {
+		cl.candidates = cl.candidates[:explainCandidates-1]
+	}
+	c.Chosen = true
+	cl.add(c)
+}
+
+func getClusterLoad(pl *model.PartitionList, cfg RebalanceConfig) map[model.BrokerID]float64 {
+	loads := cfg.brokerLoad(pl)
+	for _, ids := range [][]model.BrokerID{cfg.Brokers, cfg.ScaleOut} {
+		for _, id := range ids {
+			if _, found := loads[id]; !found {
+				loads[id] = 0
+			}
+		}
+	}
+
+	return loads
+}
+
+// explain applies the changes to the state, returning their Explanation
+func explain(step string, s *State, changes *model.PartitionList, cfg RebalanceConfig, cl *candidateList) (*Explanation, error) {
+	e := &Explanation{Step: step, Changes: changes.Copy().Partitions}
+
+	for _, p := range changes.Partitions {
+		if i, found := s.idx[keyOf(p)]; found {
+			e.Original = append(e.Original, singlepl(s.pl.Partitions[i]).Copy().Partitions[0])
+		}
+	}
+
+	lb := getClusterLoad(s.pl, cfg)
+	s.Apply(changes)
+	la := getClusterLoad(s.pl, cfg)
+	var err error
+	if e.UnbalanceBefore, err = cfg.unbalance(getBL(lb)); err != nil {
+		return nil, err
+	}
+	if e.UnbalanceAfter, err = cfg.unbalance(getBL(la)); err != nil {
+		return nil, err
+	}
+
+	for id := range la {
+		if _, found := lb[id]; !found {
+			lb[id] = 0
+		}
+	}
+	for _, b := range getBL(lb) {
+		if b.Load != la[b.ID] {
+			e.Brokers = append(e.Brokers, BrokerLoadChange{ID: b.ID, Before: b.Load, After: la[b.ID]})
+		}
+	}
+	sort.Slice(e.Brokers, func(i, j int) bool { return e.Brokers[i].ID < e.Brokers[j].ID })
+
+	if cl != nil && len(cl.candidates) > 0 {
+		e.Candidates = append([]Candidate(nil), cl.candidates...)
+	}
+
+	return e, nil
+}
@@ -0,0 +1,89 @@
+package balancer
+
+import (
+	"testing"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+func TestExplain(t *testing.T) {
+	pl := wrap([]model.Partition{
+		model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+		model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{1, 2}},
+	})
+
+	cfg := DefaultRebalanceConfig()
+	cfg.Brokers = []model.BrokerID{1, 2, 3}
+	cfg.Explain = true
+	res, err := Balance(pl, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	e := res.Explanation
+	if e == nil {
+		t.Fatalf("missing explanation")
+	}
+	if e.Step != "MoveNonLeaders" || e.Step != res.Step {
+		t.Errorf("unexpected step %s", e.Step)
+	}
+	if len(e.Original) != 1 || len(e.Changes) != 1 || e.Original[0].Replicas[1] != 2 || e.Changes[0].Replicas[1] != 3 {
+		t.Errorf("unexpected changes %v -> %v", e.Original, e.Changes)
+	}
+	if e.UnbalanceAfter >= e.UnbalanceBefore {
+		t.Errorf("unbalance not decreasing: %f -> %f", e.UnbalanceBefore, e.UnbalanceAfter)
+	}
+	if len(e.Brokers) != 2 || e.Brokers[0] != (BrokerLoadChange{ID: 2, Before: 2, After: 1}) || e.Brokers[1] != (BrokerLoadChange{ID: 3, Before: 0, After: 1}) {
+		t.Errorf("unexpected broker loads %v", e.Brokers)
+	}
+	if len(e.Candidates) != 2 || e.Candidates[0].Unbalance != e.UnbalanceAfter || e.Candidates[0].To != 3 || !e.Candidates[0].Chosen || e.Candidates[1].Chosen {
+		t.Errorf("unexpected candidates %v", e.Candidates)
+	}
+
+	cfg.Explain = false
+	res, err = Balance(pl, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if res.Explanation != nil {
+		t.Errorf("unexpected explanation %v", res.Explanation)
+	}
+}
+
+func TestExplainSeed(t *testing.T) {
+	pl := wrap([]model.Partition{
+		model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+		model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{1, 2}},
+	})
+
+	cfg := DefaultRebalanceConfig()
+	cfg.Brokers = []model.BrokerID{1, 2, 3}
+	cfg.Explain = true
+	notFirst := false
+	for seed := int64(1); seed <= 20; seed++ {
+		cfg.Seed = seed
+		res, err := Balance(pl, cfg)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		e := res.Explanation
+		chosen := 0
+		for idx, c := range e.Candidates {
+			if !c.Chosen {
+				continue
+			}
+			chosen++
+			if c.Partition != e.Changes[0].Partition || c.To != e.Changes[0].Replicas[1] {
+				t.Errorf("seed %d: chosen candidate %v, changes %v", seed, c, e.Changes)
+			}
+			if idx > 0 {
+				notFirst = true
+			}
+		}
+		if chosen != 1 {
+			t.Errorf("seed %d: unexpected candidates %v", seed, e.Candidates)
+		}
+	}
+	if !notFirst {
+		t.Errorf("the chosen candidate was always the first")
+	}
+}
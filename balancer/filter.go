@@ -0,0 +1,57 @@
+package balancer
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// TopicMatcher reports whether a topic name matches a pattern
+type TopicMatcher func(model.TopicName) bool
+
+// CompileTopicPattern compiles a topic pattern. Patterns prefixed with "re:"
+// are regular expressions, all other patterns are globs (see path.Match); a
+// pattern with no wildcards matches only the topic with the same name.
+func CompileTopicPattern(pattern string) (TopicMatcher, error) {
+	if strings.HasPrefix(pattern, "re:") {
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, "re:"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic pattern \"%s\": %s", pattern, err)
+		}
+		return func(t model.TopicName) bool { return re.MatchString(string(t)) }, nil
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid topic pattern \"%s\": %s", pattern, err)
+	}
+	return func(t model.TopicName) bool {
+		m, _ := path.Match(pattern, string(t))
+		return m
+	}, nil
+}
+
+func compileTopicPatterns(patterns []string) ([]TopicMatcher, error) {
+	matchers := make([]TopicMatcher, 0, len(patterns))
+	for _, pattern := range patterns {
+		m, err := CompileTopicPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+
+	return matchers, nil
+}
+
+func matchTopic(matchers []TopicMatcher, t model.TopicName) bool {
+	for _, m := range matchers {
+		if m(t) {
+			return true
+		}
+	}
+
+	return false
+}
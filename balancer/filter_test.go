@@ -0,0 +1,38 @@
+package balancer
+
+import (
+	"testing"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+func TestTopicPatterns(t *testing.T) {
+	tc := []struct {
+		pattern string
+		topic   model.TopicName
+		match   bool
+	}{
+		{"__consumer_offsets", "__consumer_offsets", true},
+		{"__consumer_offsets", "__consumer_offsets2", false},
+		{"prod.*", "prod.orders", true},
+		{"prod.*", "production", false},
+		{"tmp-?", "tmp-1", true},
+		{"re:^(orders|payments)$", "payments", true},
+		{"re:^(orders|payments)$", "payments.dlq", false},
+	}
+
+	for _, c := range tc {
+		m, err := CompileTopicPattern(c.pattern)
+		if err != nil {
+			t.Errorf("unexpected error %s", err)
+		} else if m(c.topic) != c.match {
+			t.Errorf("pattern %s topic %s: expected %v", c.pattern, c.topic, c.match)
+		}
+	}
+
+	for _, pattern := range []string{"re:(", "[a"} {
+		if _, err := CompileTopicPattern(pattern); err == nil {
+			t.Errorf("pattern %s: expected error", pattern)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package balancer
+
+import (
+	"fmt"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// LoadModel defines the load that the replicas of a partition put on their
+// brokers. Every replica writes the data produced to the partition, with cost
+// ProduceIn; the leader also sends it to each follower, with cost
+// ReplicationOut, and to the consumers, with cost ConsumeOut. Unless Measured
+// is set, the data produced to a partition is its weight and the data
+// consumed is its weight times its number of consumers.
+type LoadModel struct {
+	ProduceIn      float64 `json:"produce_in"`
+	ReplicationOut float64 `json:"replication_out"`
+	ConsumeOut     float64 `json:"consume_out"`
+	// Measured uses the measured BytesIn and BytesOut of the partitions as
+	// the data produced and consumed, ignoring their weight
+	Measured bool `json:"measured,omitempty"`
+}
+
+// DefaultLoadModel returns the LoadModel in which the load of a follower is
+// the weight of its partition, and the one of the leader the weight times the
+// number of replicas and consumers of its partition
+func DefaultLoadModel() LoadModel {
+	return LoadModel{ProduceIn: 1, ReplicationOut: 1, ConsumeOut: 1}
+}
+
+// String returns the coefficients of the load model, so that they are logged
+// instead of the address of the LoadModel of a RebalanceConfig
+func (lm LoadModel) String() string {
+	type loadModel LoadModel
+	return fmt.Sprintf("%+v", loadModel(lm))
+}
+
+// Validate returns an error if the costs are negative
+func (lm LoadModel) Validate() error {
+	if lm.ProduceIn < 0 || lm.ReplicationOut < 0 || lm.ConsumeOut < 0 {
+		return fmt.Errorf("invalid load model %+v: negative cost", lm)
+	}
+
+	return nil
+}
+
+// replicaLoad returns the load of the replica in position idx of the replicas
+// of the partition
+func (lm LoadModel) replicaLoad(p model.Partition, idx int) float64 {
+	if lm.Measured {
+		if idx != 0 {
+			return lm.ProduceIn * p.BytesIn
+		}
+		return (lm.ProduceIn+lm.ReplicationOut*float64(len(p.Replicas)-1))*p.BytesIn + lm.ConsumeOut*p.BytesOut
+	}
+
+	if idx != 0 {
+		return p.Weight * lm.ProduceIn
+	}
+	return p.Weight * (lm.ProduceIn + lm.ReplicationOut*float64(len(p.Replicas)-1) + lm.ConsumeOut*float64(p.NumConsumers))
+}
+
+// moveLoad returns the load transferred by moving a replica of the partition,
+// either the leader or a follower: the load of a follower, that with the
+// default load model is the weight of the partition
+func (lm LoadModel) moveLoad(p model.Partition) float64 {
+	return lm.replicaLoad(p, 1)
+}
+
+// loadModel returns the LoadModel of the configuration
+func (cfg RebalanceConfig) loadModel() LoadModel {
+	if cfg.LoadModel == nil {
+		return DefaultLoadModel()
+	}
+	return *cfg.LoadModel
+}
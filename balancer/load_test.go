@@ -0,0 +1,210 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+func TestReplicaLoad(t *testing.T) {
+	p := model.Partition{
+		Topic:        "a",
+		Partition:    1,
+		Replicas:     []model.BrokerID{1, 2, 3},
+		Weight:       2,
+		NumConsumers: 4,
+		BytesIn:      100,
+		BytesOut:     500,
+	}
+
+	cases := []struct {
+		lm       LoadModel
+		leader   float64
+		follower float64
+	}{
+		{DefaultLoadModel(), 2 * (3 + 4), 2},
+		{LoadModel{ProduceIn: 1, ReplicationOut: 0.5, ConsumeOut: 2}, 2 * (1 + 0.5*2 + 2*4), 2},
+		{LoadModel{ProduceIn: 2, ReplicationOut: 1, ConsumeOut: 0}, 2 * (2 + 2), 4},
+		{LoadModel{ProduceIn: 1, ReplicationOut: 1, ConsumeOut: 1, Measured: true}, (1+2)*100 + 500, 100},
+		{LoadModel{ProduceIn: 2, ReplicationOut: 0.5, ConsumeOut: 0.1, Measured: true}, (2+0.5*2)*100 + 0.1*500, 200},
+	}
+
+	for _, c := range cases {
+		if l := c.lm.replicaLoad(p, 0); l != c.leader {
+			t.Errorf("%+v: unexpected leader load %v, expected %v", c.lm, l, c.leader)
+		}
+		for idx := 1; idx < len(p.Replicas); idx++ {
+			if l := c.lm.replicaLoad(p, idx); l != c.follower {
+				t.Errorf("%+v: unexpected follower load %v, expected %v", c.lm, l, c.follower)
+			}
+		}
+	}
+
+	if err := DefaultLoadModel().Validate(); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+	if err := (LoadModel{ProduceIn: 1, ReplicationOut: -1}).Validate(); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestBalanceLoadModel(t *testing.T) {
+	pl := wrap([]model.Partition{
+		{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}, NumConsumers: 2, Weight: 1},
+		{Topic: "b", Partition: 1, Replicas: []model.BrokerID{2, 3}, Weight: 1},
+		{Topic: "c", Partition: 1, Replicas: []model.BrokerID{3}, NumConsumers: 1, Weight: 1},
+	})
+
+	cases := []struct {
+		lm       *LoadModel
+		expected map[model.BrokerID]float64
+	}{
+		{nil, map[model.BrokerID]float64{1: 4, 2: 3, 3: 3}},
+		{&LoadModel{ProduceIn: 1, ReplicationOut: 1}, map[model.BrokerID]float64{1: 2, 2: 3, 3: 2}},
+		{&LoadModel{ProduceIn: 2, ConsumeOut: 1}, map[model.BrokerID]float64{1: 4, 2: 4, 3: 5}},
+	}
+
+	for _, c := range cases {
+		cfg := DefaultRebalanceConfig()
+		cfg.LoadModel = c.lm
+		if loads := cfg.brokerLoad(pl); !reflect.DeepEqual(loads, c.expected) {
+			t.Errorf("%+v: unexpected loads %v, expected %v", c.lm, loads, c.expected)
+		}
+		r, err := New(DefaultSteps()...).Report(context.Background(), pl, cfg, 1)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		for _, b := range r.Brokers {
+			if b.Load != c.expected[b.ID] {
+				t.Errorf("%+v: unexpected report load %v of broker %d", c.lm, b.Load, b.ID)
+			}
+		}
+	}
+
+	cfg := DefaultRebalanceConfig()
+	cfg.LoadModel = &LoadModel{ProduceIn: 1, ReplicationOut: -1}
+	if _, err := Balance(pl, cfg); err == nil {
+		t.Errorf("expected error")
+	}
+
+	cfg.LoadModel = &LoadModel{ProduceIn: 1, ReplicationOut: 1, ConsumeOut: 1, Measured: true}
+	if _, err := Balance(pl, cfg); err == nil {
+		t.Errorf("expected error")
+	}
+	pl.Partitions[0].BytesIn = -1
+	if _, err := Balance(pl, cfg); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestBalanceMeasuredLoad(t *testing.T) {
+	// the measured traffic overrides the weights
+	pl := wrap([]model.Partition{
+		{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1}, Weight: 5, BytesIn: 1},
+		{Topic: "a", Partition: 2, Replicas: []model.BrokerID{1}, Weight: 5, BytesIn: 1},
+		{Topic: "a", Partition: 3, Replicas: []model.BrokerID{2}, Weight: 1, BytesIn: 5},
+		{Topic: "a", Partition: 4, Replicas: []model.BrokerID{2}, Weight: 1, BytesIn: 5},
+		{Topic: "a", Partition: 5, Replicas: []model.BrokerID{3}, Weight: 1, BytesIn: 1},
+	})
+	cfg := DefaultRebalanceConfig()
+	cfg.MinReplicasForRebalancing = 1
+	cfg.AllowLeaderRebalancing = true
+
+	cases := []struct {
+		lm        *LoadModel
+		partition model.PartitionID
+	}{
+		{nil, 1},
+		{&LoadModel{ProduceIn: 1, ReplicationOut: 1, ConsumeOut: 1, Measured: true}, 3},
+	}
+
+	for _, c := range cases {
+		cfg.LoadModel = c.lm
+		res, err := Balance(pl, cfg)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if len(res.Changes.Partitions) != 1 {
+			t.Fatalf("%+v: unexpected changes %v", c.lm, res.Changes)
+		}
+		if p := res.Changes.Partitions[0]; p.Partition != c.partition || !reflect.DeepEqual(p.Replicas, []model.BrokerID{3}) {
+			t.Errorf("%+v: unexpected change %v", c.lm, p)
+		}
+	}
+}
+
+func TestMoveLeadersOscillates(t *testing.T) {
+	// moves are evaluated as transferring the load of a follower, even the
+	// ones of leaders: a leader move can leave the cluster more unbalanced
+	// than it was, and the moves of leaders and followers can undo each
+	// other. This is accepted, as the moves planned are bounded.
+	b := New(DefaultSteps()...)
+	cfg := DefaultRebalanceConfig()
+	cfg.AllowLeaderRebalancing = true
+	pl := oscillatingCluster()
+	s := NewState(pl)
+	seen := map[string]bool{fmt.Sprint(s.PartitionList().Partitions): true}
+	repeated := false
+	for moves := 0; moves < DefaultMaxMoves(pl) && !repeated; moves++ {
+		res, err := b.BalanceState(context.Background(), s, cfg)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if len(res.Changes.Partitions) == 0 {
+			t.Fatalf("rebalancing converged")
+		}
+		k := fmt.Sprint(s.PartitionList().Partitions)
+		repeated, seen[k] = seen[k], true
+	}
+	if !repeated {
+		t.Errorf("moves not undone")
+	}
+
+	// moving followers alone always decreases the unbalance, and the
+	// number of moves planned never exceeds the bound
+	for seed := int64(0); seed < 10; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		pl := randomCluster(rng, 3+rng.Intn(8), 50+rng.Intn(200))
+		for idx := range pl.Partitions {
+			pl.Partitions[idx].NumConsumers = rng.Intn(4)
+		}
+		cfg := DefaultRebalanceConfig()
+		cfg.AllowLeaderRebalancing = seed%2 == 0
+		cfg.Explain = true
+		if seed%3 == 1 {
+			cfg.LoadModel = &LoadModel{ProduceIn: 0.5, ReplicationOut: 2, ConsumeOut: 3}
+		}
+
+		s := NewState(pl)
+		moves := 0
+		for ; moves < DefaultMaxMoves(pl); moves++ {
+			res, err := b.BalanceState(context.Background(), s, cfg)
+			if err != nil {
+				t.Fatalf("seed %d: unexpected error %s", seed, err)
+			}
+			if len(res.Changes.Partitions) == 0 {
+				break
+			}
+			e := res.Explanation
+			if res.Step == "MoveNonLeaders" && e.UnbalanceAfter >= e.UnbalanceBefore {
+				t.Fatalf("seed %d: unexpected unbalance %v -> %v", seed, e.UnbalanceBefore, e.UnbalanceAfter)
+			}
+		}
+		if moves == DefaultMaxMoves(pl) && !cfg.AllowLeaderRebalancing {
+			t.Errorf("seed %d: rebalancing did not converge", seed)
+		}
+
+		cfg.Explain = false
+		r, err := b.Report(context.Background(), pl, cfg, 0)
+		if err != nil {
+			t.Fatalf("seed %d: unexpected error %s", seed, err)
+		}
+		if r.MovesNeeded > DefaultMaxMoves(pl) || !r.Converged && r.MovesNeeded != DefaultMaxMoves(pl) {
+			t.Errorf("seed %d: unexpected moves needed %d (converged: %v)", seed, r.MovesNeeded, r.Converged)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package balancer
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Metric computes the unbalance of the loads of the brokers of a cluster: 0
+// if the load is evenly distributed, larger the more it is unbalanced. The
+// loads must not be modified.
+type Metric func(loads []float64) float64
+
+// DefaultMetric is the name of the metric used if none is specified
+const DefaultMetric = "squares"
+
+var (
+	metricsLock sync.RWMutex
+	metrics     = map[string]Metric{
+		// sum of the squared relative deviations from the mean load
+		"squares": squaresMetric,
+		// relative deviation of the most loaded broker from the mean load
+		"max": maxMetric,
+		// difference between the most and least loaded brokers, relative to
+		// the mean load
+		"spread": spreadMetric,
+		// Gini coefficient of the loads
+		"gini": giniMetric,
+	}
+)
+
+// RegisterMetric makes a metric available by name, e.g. to select it from
+// the command line. It panics if a metric with the same name is already
+// registered.
+func RegisterMetric(name string, m Metric) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	if _, found := metrics[name]; found {
+		panic(fmt.Sprintf("metric %s already registered", name))
+	}
+	metrics[name] = m
+}
+
+// LookupMetric returns the registered metric with the specified name (or the
+// default one, if name is empty)
+func LookupMetric(name string) (Metric, error) {
+	if name == "" {
+		name = DefaultMetric
+	}
+
+	metricsLock.RLock()
+	defer metricsLock.RUnlock()
+
+	m, found := metrics[name]
+	if !found {
+		return nil, fmt.Errorf("unknown metric %s", name)
+	}
+
+	return m, nil
+}
+
+// RegisteredMetrics returns the names of the registered metrics, sorted by
+// name
+func RegisteredMetrics() []string {
+	metricsLock.RLock()
+	defer metricsLock.RUnlock()
+
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// unbalanceFunc returns the function computing the unbalance of the broker
+// loads according to the metric of the configuration, or an error if the
+// metric is not registered
+func (cfg RebalanceConfig) unbalanceFunc() (func([]brokerLoad) float64, error) {
+	if cfg.Metric == "" || cfg.Metric == DefaultMetric {
+		return getUnbalanceBL, nil
+	}
+	m, err := LookupMetric(cfg.Metric)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(bl []brokerLoad) float64 {
+		loads := make([]float64, len(bl))
+		for idx, b := range bl {
+			loads[idx] = b.Load
+		}
+		return m(loads)
+	}, nil
+}
+
+// unbalance returns the unbalance of the broker loads according to the
+// metric of the configuration
+func (cfg RebalanceConfig) unbalance(bl []brokerLoad) (float64, error) {
+	unbalance, err := cfg.unbalanceFunc()
+	if err != nil {
+		return 0, err
+	}
+	return unbalance(bl), nil
+}
+
+func squaresMetric(loads []float64) float64 {
+	var sum float64
+	for _, load := range loads {
+		sum += load
+	}
+	avg := sum / float64(len(loads))
+
+	var u float64
+	for _, load := range loads {
+		rel := load/avg - 1.0
+		u += rel * rel
+	}
+
+	return u
+}
+
+func maxMetric(loads []float64) float64 {
+	var sum, max float64
+	for idx, load := range loads {
+		sum += load
+		if idx == 0 || load > max {
+			max = load
+		}
+	}
+
+	return max/(sum/float64(len(loads))) - 1.0
+}
+
+func spreadMetric(loads []float64) float64 {
+	var sum, min, max float64
+	for idx, load := range loads {
+		sum += load
+		if idx == 0 || load < min {
+			min = load
+		}
+		if idx == 0 || load > max {
+			max = load
+		}
+	}
+
+	return (max - min) / (sum / float64(len(loads)))
+}
+
+func giniMetric(loads []float64) float64 {
+	sorted := append([]float64(nil), loads...)
+	sort.Float64s(sorted)
+
+	// G = Σ (2i - n - 1) L(i) / (n ΣL), with the loads L(i) sorted in
+	// ascending order and i starting from 1
+	n := float64(len(sorted))
+	var sum, weighted float64
+	for idx, load := range sorted {
+		sum += load
+		weighted += (2*float64(idx+1) - n - 1) * load
+	}
+
+	return weighted / (n * sum)
+}
@@ -0,0 +1,127 @@
+package balancer
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+func TestMetrics(t *testing.T) {
+	cases := []struct {
+		metric   string
+		loads    []float64
+		expected float64
+	}{
+		{"squares", []float64{1, 2, 3, 6}, 14.0 / 9},
+		{"max", []float64{1, 2, 3, 6}, 1},
+		{"spread", []float64{1, 2, 3, 6}, 5.0 / 3},
+		{"gini", []float64{1, 2, 3, 6}, 1.0 / 3},
+		{"gini", []float64{0, 0, 0, 4}, 0.75},
+	}
+
+	for _, c := range cases {
+		m, err := LookupMetric(c.metric)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if u := m(c.loads); math.Abs(u-c.expected) > 1e-12 {
+			t.Errorf("%s: unexpected unbalance %v, expected %v", c.metric, u, c.expected)
+		}
+		if u := m([]float64{3, 3, 3}); u != 0 {
+			t.Errorf("%s: unexpected unbalance %v of a balanced cluster", c.metric, u)
+		}
+	}
+
+	// the default metric is the one used by getUnbalanceBL
+	m, _ := LookupMetric("")
+	bl := []brokerLoad{{1, 0.1}, {2, 0.7}, {3, 1.3}}
+	if u, expected := m([]float64{0.1, 0.7, 1.3}), getUnbalanceBL(bl); u != expected {
+		t.Errorf("unexpected unbalance %v, expected %v", u, expected)
+	}
+
+	if _, err := LookupMetric("foo"); err == nil {
+		t.Errorf("expected error")
+	}
+	if names := RegisteredMetrics(); len(names) < 4 || names[0] != "gini" {
+		t.Errorf("unexpected metrics %v", names)
+	}
+}
+
+func TestRegisterMetric(t *testing.T) {
+	RegisterMetric("test-min", func(loads []float64) float64 {
+		return -loads[0]
+	})
+	if _, err := LookupMetric("test-min"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic")
+		}
+	}()
+	RegisterMetric("max", maxMetric)
+}
+
+func TestBalanceMetric(t *testing.T) {
+	b := New(DefaultSteps()...)
+	rng := rand.New(rand.NewSource(1))
+	pl := randomCluster(rng, 8, 300)
+
+	for _, metric := range []string{"squares", "max", "spread", "gini"} {
+		cfg := DefaultRebalanceConfig()
+		cfg.Metric = metric
+		cfg.Explain = true
+
+		m, _ := LookupMetric(metric)
+		s := NewState(pl)
+		moves := 0
+		for ; moves < 200; moves++ {
+			res, err := b.BalanceState(context.Background(), s, cfg)
+			if err != nil {
+				t.Fatalf("%s: unexpected error %s", metric, err)
+			}
+			if len(res.Changes.Partitions) == 0 {
+				break
+			}
+			e := res.Explanation
+			if res.Step == "MoveNonLeaders" && e.UnbalanceAfter >= e.UnbalanceBefore-cfg.MinUnbalance {
+				t.Fatalf("%s: unexpected unbalance %v -> %v", metric, e.UnbalanceBefore, e.UnbalanceAfter)
+			}
+		}
+		if moves == 0 {
+			t.Errorf("%s: no moves", metric)
+		}
+
+		var loads []float64
+		for _, b := range getBL(getBrokerLoad(s.PartitionList(), DefaultLoadModel())) {
+			loads = append(loads, b.Load)
+		}
+		h, err := GetHealth(s.PartitionList(), cfg)
+		if err != nil || h.Unbalance != m(loads) {
+			t.Errorf("%s: unexpected health %v, error %v", metric, h, err)
+		}
+	}
+}
+
+func TestBalanceUnknownMetric(t *testing.T) {
+	pl := wrap([]model.Partition{
+		{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+	})
+	cfg := DefaultRebalanceConfig()
+	cfg.Metric = "foo"
+
+	if _, err := Balance(pl, cfg); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, err := GetHealth(pl, cfg); err == nil {
+		t.Errorf("expected error")
+	}
+	// the steps invoked directly don't validate the configuration
+	if _, err := MoveNonLeaders(pl, cfg); err == nil {
+		t.Errorf("expected error")
+	}
+}
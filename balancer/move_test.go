@@ -0,0 +1,303 @@
+package balancer
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// moveReference is the straightforward implementation of move, that computes
+// from scratch the unbalance of every candidate
+func moveReference(pl *model.PartitionList, cfg RebalanceConfig, leaders bool) (*model.PartitionList, error) {
+	var cp model.Partition
+	var cr, cb model.BrokerID
+
+	bl := getBL(getClusterLoad(pl, cfg))
+	su := getUnbalanceBL(bl)
+	cu := su
+
+	for _, p := range pl.Partitions {
+		if p.Pinned || p.NumReplicas < cfg.MinReplicasForRebalancing {
+			continue
+		}
+
+		replicas := p.Replicas[1:]
+		if leaders {
+			replicas = p.Replicas[0:1]
+		}
+
+		for _, r := range replicas {
+			ridx := -1
+			var rload float64
+			for idx, b := range bl {
+				if b.ID == r {
+					ridx = idx
+					rload = b.Load
+					bl[idx].Load -= p.Weight
+				}
+			}
+			if ridx == -1 {
+				return nil, fmt.Errorf("assertion failed: replica %d not in broker loads %v", r, bl)
+			}
+
+			for idx, b := range bl {
+				if !inBrokerList(p.Brokers, b.ID) || inBrokerList(p.Replicas, b.ID) {
+					continue
+				}
+				if cfg.Racks != nil && rackConflicts(p, cfg.Racks, r, b.ID) > rackConflicts(p, cfg.Racks, r, r) {
+					continue
+				}
+
+				bload := bl[idx].Load
+				bl[idx].Load += p.Weight
+				if u := getUnbalanceBL(bl); u < cu {
+					cu, cp, cr, cb = u, p, r, b.ID
+				}
+				bl[idx].Load = bload
+			}
+
+			bl[ridx].Load = rload
+		}
+	}
+
+	if cu < su-cfg.MinUnbalance {
+		return replacepl(cp, cr, cb), nil
+	}
+
+	return nil, nil
+}
+
+// referenceSteps returns the default steps using moveReference
+func referenceSteps() []Step {
+	var steps []Step
+	for _, s := range DefaultSteps() {
+		switch s.Name() {
+		case "MoveLeaders":
+			steps = append(steps, NewStep(s.Name(), func(pl *model.PartitionList, cfg RebalanceConfig) (*model.PartitionList, error) {
+				if !cfg.AllowLeaderRebalancing {
+					return nil, nil
+				}
+				return moveReference(pl, cfg, true)
+			}))
+		case "MoveNonLeaders":
+			steps = append(steps, NewStep(s.Name(), func(pl *model.PartitionList, cfg RebalanceConfig) (*model.PartitionList, error) {
+				return moveReference(pl, cfg, false)
+			}))
+		default:
+			steps = append(steps, s)
+		}
+	}
+	return steps
+}
+
+// randomCluster returns a cluster of the specified number of brokers and
+// partitions, with random weights and replica assignments. Some topics are
+// restricted to a subset of the brokers.
+func randomCluster(rng *rand.Rand, brokers, partitions int) *model.PartitionList {
+	pl := emptypl()
+	for len(pl.Partitions) < partitions {
+		topic := model.TopicName(fmt.Sprintf("topic%d", len(pl.Partitions)))
+		weight := float64(1 + rng.Intn(100))
+		replicas := 1 + rng.Intn(3)
+		if replicas > brokers {
+			replicas = brokers
+		}
+		allowed := rng.Perm(brokers)
+		if rng.Intn(4) == 0 {
+			allowed = allowed[:replicas+rng.Intn(brokers-replicas+1)]
+		}
+		var bs []model.BrokerID
+		for _, id := range allowed {
+			bs = append(bs, model.BrokerID(id+1))
+		}
+		for idx := 0; idx < 1+rng.Intn(32) && len(pl.Partitions) < partitions; idx++ {
+			p := model.Partition{Topic: topic, Partition: model.PartitionID(idx), Weight: weight}
+			for _, i := range rng.Perm(len(bs))[:replicas] {
+				p.Replicas = append(p.Replicas, bs[i])
+			}
+			if len(bs) < brokers {
+				p.Brokers = bs
+			}
+			pl.Partitions = append(pl.Partitions, p)
+		}
+	}
+	return pl
+}
+
+func randomRacks(rng *rand.Rand, brokers int) map[model.BrokerID]string {
+	racks := make(map[model.BrokerID]string)
+	for id := 1; id <= brokers; id++ {
+		racks[model.BrokerID(id)] = fmt.Sprintf("rack%d", rng.Intn(3))
+	}
+	return racks
+}
+
+func TestMoveMatchesReference(t *testing.T) {
+	b, ref := New(DefaultSteps()...), New(referenceSteps()...)
+
+	for seed := int64(0); seed < 40; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		brokers := 2 + rng.Intn(12)
+		pl := randomCluster(rng, brokers, 1+rng.Intn(200))
+		cfg := DefaultRebalanceConfig()
+		cfg.AllowLeaderRebalancing = seed%2 == 0
+		if seed%3 == 0 {
+			cfg.Racks = randomRacks(rng, brokers)
+		}
+
+		state, rstate := pl, pl.Copy()
+		for step := 0; step < 50; step++ {
+			res, err := b.Balance(state, cfg)
+			if err != nil {
+				t.Fatalf("seed %d step %d: unexpected error %s", seed, step, err)
+			}
+			rres, err := ref.Balance(rstate, cfg)
+			if err != nil {
+				t.Fatalf("seed %d step %d: unexpected reference error %s", seed, step, err)
+			}
+			if !reflect.DeepEqual(res.Changes, rres.Changes) {
+				t.Fatalf("seed %d step %d: got %v, reference %v", seed, step, res.Changes, rres.Changes)
+			}
+			if len(res.Changes.Partitions) == 0 {
+				break
+			}
+			state, rstate = res.State, rres.State
+		}
+	}
+}
+
+func TestMoveParallel(t *testing.T) {
+	b := New(DefaultSteps()...)
+
+	for seed := int64(0); seed < 10; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		brokers := 2 + rng.Intn(30)
+		pl := randomCluster(rng, brokers, 300+rng.Intn(1000))
+		cfg := DefaultRebalanceConfig()
+		cfg.AllowLeaderRebalancing = seed%2 == 0
+		cfg.Explain = seed%3 == 0
+		if seed%4 == 0 {
+			cfg.Racks = randomRacks(rng, brokers)
+		}
+
+		for _, parallelism := range []int{2, 3, 8, 0} {
+			state, pstate := pl, pl.Copy()
+			pcfg := cfg
+			cfg.Parallelism, pcfg.Parallelism = 1, parallelism
+			for step := 0; step < 10; step++ {
+				res, err := b.Balance(state, cfg)
+				if err != nil {
+					t.Fatalf("seed %d step %d: unexpected error %s", seed, step, err)
+				}
+				pres, err := b.Balance(pstate, pcfg)
+				if err != nil {
+					t.Fatalf("seed %d parallelism %d step %d: unexpected error %s", seed, parallelism, step, err)
+				}
+				if !reflect.DeepEqual(res.Changes, pres.Changes) || !reflect.DeepEqual(res.Explanation, pres.Explanation) {
+					t.Fatalf("seed %d parallelism %d step %d: got %v, sequential %v", seed, parallelism, step, pres, res)
+				}
+				if len(res.Changes.Partitions) == 0 {
+					break
+				}
+				state, pstate = res.State, pres.State
+			}
+		}
+	}
+}
+
+func TestMoveSeed(t *testing.T) {
+	differs := false
+	for seed := int64(1); seed <= 20; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		pl := randomCluster(rng, 2+rng.Intn(10), 200+rng.Intn(300))
+		for idx := range pl.Partitions {
+			pl.Partitions[idx].Weight = 1
+		}
+		cfg := DefaultRebalanceConfig()
+		for _, s := range DefaultSteps()[:3] {
+			s.Apply(pl, cfg)
+		}
+		shuffled := pl.Copy()
+		rng.Shuffle(len(shuffled.Partitions), func(i, j int) {
+			shuffled.Partitions[i], shuffled.Partitions[j] = shuffled.Partitions[j], shuffled.Partitions[i]
+		})
+
+		unseeded, err := move(pl, cfg, false)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		cfg.Seed = seed
+		var expected *model.PartitionList
+		for _, parallelism := range []int{1, 3} {
+			cfg.Parallelism = parallelism
+			for _, l := range []*model.PartitionList{pl, shuffled} {
+				res, err := move(l, cfg, false)
+				if err != nil {
+					t.Fatalf("unexpected error %s", err)
+				}
+				if expected == nil {
+					expected = res
+				} else if !reflect.DeepEqual(res, expected) {
+					t.Fatalf("seed %d: got %v, expected %v", seed, res, expected)
+				}
+			}
+		}
+		if !reflect.DeepEqual(unseeded, expected) {
+			differs = true
+		}
+	}
+	if !differs {
+		t.Errorf("the seed never changed the move")
+	}
+}
+
+func benchmarkMove(bench *testing.B, fn func(*model.PartitionList, RebalanceConfig, bool) (*model.PartitionList, error), brokers, partitions, parallelism int) {
+	pl := randomCluster(rand.New(rand.NewSource(1)), brokers, partitions)
+	cfg := DefaultRebalanceConfig()
+	cfg.Parallelism = parallelism
+	for _, s := range DefaultSteps()[:3] {
+		if _, err := s.Apply(pl, cfg); err != nil {
+			bench.Fatalf("unexpected error %s", err)
+		}
+	}
+
+	bench.ResetTimer()
+	for i := 0; i < bench.N; i++ {
+		if _, err := fn(pl, cfg, false); err != nil {
+			bench.Fatalf("unexpected error %s", err)
+		}
+	}
+}
+
+var benchmarkSizes = []struct{ brokers, partitions int }{
+	{10, 1000},
+	{50, 5000},
+	{200, 20000},
+}
+
+func BenchmarkMove(bench *testing.B) {
+	for _, s := range benchmarkSizes {
+		bench.Run(fmt.Sprintf("%dx%d", s.brokers, s.partitions), func(bench *testing.B) {
+			benchmarkMove(bench, move, s.brokers, s.partitions, 1)
+		})
+	}
+}
+
+func BenchmarkMoveReference(bench *testing.B) {
+	for _, s := range benchmarkSizes {
+		bench.Run(fmt.Sprintf("%dx%d", s.brokers, s.partitions), func(bench *testing.B) {
+			benchmarkMove(bench, moveReference, s.brokers, s.partitions, 1)
+		})
+	}
+}
+
+func BenchmarkMoveParallel(bench *testing.B) {
+	for _, s := range benchmarkSizes {
+		bench.Run(fmt.Sprintf("%dx%d", s.brokers, s.partitions), func(bench *testing.B) {
+			benchmarkMove(bench, move, s.brokers, s.partitions, 0)
+		})
+	}
+}
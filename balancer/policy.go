@@ -0,0 +1,77 @@
+package balancer
+
+import (
+	"fmt"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// Policy is an ordered list of rules setting the desired replication of the
+// partitions of the topics they match. Only the first matching rule is applied
+// to each partition.
+type Policy struct {
+	Version int          `json:"version"`
+	Rules   []PolicyRule `json:"rules"`
+}
+
+// PolicyRule sets the replication of the partitions of the topics matching
+// Topic (see CompileTopicPattern). Zero values leave the partitions unchanged.
+type PolicyRule struct {
+	Topic            string           `json:"topic"`
+	NumReplicas      int              `json:"num_replicas,omitempty"`
+	Brokers          []model.BrokerID `json:"brokers,omitempty"`
+	WeightMultiplier float64          `json:"weight_multiplier,omitempty"`
+}
+
+// ApplyPolicy applies the policy rules to the partitions in pl. It has to be
+// applied once, before balancing.
+func ApplyPolicy(pl *model.PartitionList, policy *Policy) error {
+	matchers := make([]TopicMatcher, 0, len(policy.Rules))
+	hasMultipliers := false
+	for _, rule := range policy.Rules {
+		if rule.NumReplicas < 0 {
+			return fmt.Errorf("policy rule %v has negative number of replicas", rule)
+		}
+		if rule.WeightMultiplier < 0 {
+			return fmt.Errorf("policy rule %v has negative weight multiplier", rule)
+		}
+		if rule.NumReplicas > 0 && rule.Brokers != nil && rule.NumReplicas > len(rule.Brokers) {
+			return fmt.Errorf("policy rule %v has more replicas than brokers", rule)
+		}
+		m, err := CompileTopicPattern(rule.Topic)
+		if err != nil {
+			return fmt.Errorf("policy rule %v: %s", rule, err)
+		}
+		matchers = append(matchers, m)
+		hasMultipliers = hasMultipliers || rule.WeightMultiplier != 0
+	}
+
+	// partitions either all have weights or none has: if we need to apply a
+	// multiplier give all of them the default weight first
+	if hasMultipliers && len(pl.Partitions) > 0 && pl.Partitions[0].Weight == 0 {
+		for idx := range pl.Partitions {
+			pl.Partitions[idx].Weight = 1.0
+		}
+	}
+
+	for idx, p := range pl.Partitions {
+		for ridx, rule := range policy.Rules {
+			if !matchers[ridx](p.Topic) {
+				continue
+			}
+
+			if rule.NumReplicas != 0 {
+				pl.Partitions[idx].NumReplicas = rule.NumReplicas
+			}
+			if rule.Brokers != nil {
+				pl.Partitions[idx].Brokers = rule.Brokers
+			}
+			if rule.WeightMultiplier != 0 {
+				pl.Partitions[idx].Weight *= rule.WeightMultiplier
+			}
+			break
+		}
+	}
+
+	return nil
+}
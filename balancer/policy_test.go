@@ -0,0 +1,48 @@
+package balancer
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+func TestPolicy(t *testing.T) {
+	policy := &Policy{Version: 1, Rules: []PolicyRule{
+		{Topic: "prod.*", NumReplicas: 3},
+		{Topic: "re:^prod\\.", NumReplicas: 4},
+		{Topic: "tmp.*", NumReplicas: 2, Brokers: []model.BrokerID{4, 5}, WeightMultiplier: 0.5},
+	}}
+
+	pl := wrap([]model.Partition{
+		model.Partition{Topic: "prod.a", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+		model.Partition{Topic: "tmp.a", Partition: 1, Replicas: []model.BrokerID{1, 2, 3}},
+		model.Partition{Topic: "other", Partition: 1, Replicas: []model.BrokerID{1}, NumReplicas: 2},
+	})
+	if err := ApplyPolicy(pl, policy); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := wrap([]model.Partition{
+		model.Partition{Topic: "prod.a", Partition: 1, Replicas: []model.BrokerID{1, 2}, Weight: 1.0, NumReplicas: 3},
+		model.Partition{Topic: "tmp.a", Partition: 1, Replicas: []model.BrokerID{1, 2, 3}, Weight: 0.5, NumReplicas: 2, Brokers: []model.BrokerID{4, 5}},
+		model.Partition{Topic: "other", Partition: 1, Replicas: []model.BrokerID{1}, Weight: 1.0, NumReplicas: 2},
+	})
+	if !reflect.DeepEqual(expected, pl) {
+		t.Errorf("expected %v, got %v", expected, pl)
+	}
+}
+
+func TestPolicyInvalid(t *testing.T) {
+	for _, rule := range []PolicyRule{
+		{Topic: "re:("},
+		{Topic: "a", NumReplicas: -1},
+		{Topic: "a", WeightMultiplier: -1},
+		{Topic: "a", NumReplicas: 3, Brokers: []model.BrokerID{1, 2}},
+	} {
+		pl := wrap([]model.Partition{model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1}}})
+		if err := ApplyPolicy(pl, &Policy{Version: 1, Rules: []PolicyRule{rule}}); err == nil {
+			t.Errorf("policy rule %v: expected error", rule)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// maximum number of topics listed for each broker in a Report
+const reportTopics = 3
+
+// Report describes the current workload distribution of the cluster
+type Report struct {
+	Brokers []BrokerReport `json:"brokers"`
+	// Topics is the load caused by each topic on the whole cluster
+	Topics     []TopicLoad `json:"topics"`
+	Unbalance  float64     `json:"unbalance"`
+	Violations []Violation `json:"violations"`
+	// MovesNeeded is the number of reassignments the balancer would propose to
+	// fix the violations and reach MinUnbalance. If Converged is false, the
+	// balancer was stopped after the maximum number of reassignments or
+	// because the context was done.
+	MovesNeeded int  `json:"moves_needed"`
+	Converged   bool `json:"converged"`
+}
+
+// BrokerReport is the load of a broker, the number of replicas (and leaders)
+// it hosts and the topics contributing the most to its load
+type BrokerReport struct {
+	ID       model.BrokerID `json:"id"`
+	Load     float64        `json:"load"`
+	Replicas int            `json:"replicas"`
+	Leaders  int            `json:"leaders"`
+	Topics   []TopicLoad    `json:"topics"`
+}
+
+// TopicLoad is the load caused by the replicas of a topic on a broker
+type TopicLoad struct {
+	Topic model.TopicName `json:"topic"`
+	Load  float64         `json:"load"`
+}
+
+// Violation is a partition not satisfying its constraints
+type Violation struct {
+	Topic     model.TopicName   `json:"topic"`
+	Partition model.PartitionID `json:"partition"`
+	Problem   string            `json:"problem"`
+}
+
+// Report returns a Report of the partition list. At most maxMoves
+// reassignments are planned to compute MovesNeeded (DefaultMaxMoves if
+// maxMoves is 0); planning also stops when the context is done. The partition
+// list passed as argument is not modified.
+func (b *Balancer) Report(ctx context.Context, pl *model.PartitionList, cfg RebalanceConfig, maxMoves int) (*Report, error) {
+	state, err := prepare(pl, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := getHealth(state, cfg)
+	if err != nil {
+		return nil, err
+	}
+	r := &Report{
+		Brokers:    getBrokerReports(state, cfg),
+		Topics:     getTopicLoads(state, cfg.loadModel()),
+		Unbalance:  h.Unbalance,
+		Violations: h.Violations,
+	}
+
+	if len(pl.Partitions) == 0 {
+		r.Converged = true
+		return r, nil
+	}
+
+	// the moves needed don't depend on how many plans they are split in
+	cfg.Explain = false
+	cfg.MaxMovesFrom, cfg.MaxMovesTo = 0, 0
+	if maxMoves == 0 {
+		maxMoves = DefaultMaxMoves(state)
+	}
+	s := NewState(pl)
+	for r.MovesNeeded < maxMoves {
+		res, err := b.BalanceState(ctx, s, cfg)
+		if err != nil && ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(res.Changes.Partitions) == 0 {
+			r.Converged = true
+			break
+		}
+		r.MovesNeeded += len(res.Changes.Partitions)
+	}
+
+	return r, nil
+}
+
+// DefaultMaxMoves returns the maximum number of reassignments planned by
+// Report and Simulate if not specified: the number of replicas of the
+// partitions. The balancer doesn't always converge (e.g. if
+// AllowLeaderRebalancing is set, the moves of leaders and followers can undo
+// each other), and a plan moving more replicas than the cluster has is not
+// worth applying anyway.
+func DefaultMaxMoves(pl *model.PartitionList) int {
+	n := 0
+	for _, p := range pl.Partitions {
+		if p.NumReplicas > len(p.Replicas) {
+			n += p.NumReplicas
+		} else {
+			n += len(p.Replicas)
+		}
+	}
+	if n == 0 {
+		return 1
+	}
+
+	return n
+}
+
+// Health is the current unbalance of the cluster and the partitions violating
+// their constraints
+type Health struct {
+	Unbalance  float64
+	Violations []Violation
+}
+
+// GetHealth returns the Health of the partition list. Unlike Report, it
+// doesn't plan any reassignment. The partition list passed as argument is not
+// modified.
+func GetHealth(pl *model.PartitionList, cfg RebalanceConfig) (*Health, error) {
+	state, err := prepare(pl, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return getHealth(state, cfg)
+}
+
+func getHealth(pl *model.PartitionList, cfg RebalanceConfig) (*Health, error) {
+	u, err := cfg.unbalance(getBL(getClusterLoad(pl, cfg)))
+	if err != nil {
+		return nil, err
+	}
+	h := &Health{
+		Unbalance:  u,
+		Violations: GetViolations(pl),
+	}
+	ai, err := cfg.affinityIndex(pl)
+	if err != nil {
+		return nil, err
+	}
+	if ai != nil {
+		hard, _ := ai.violations(pl)
+		h.Violations = append(h.Violations, hard...)
+	}
+	ci, err := cfg.coPartitionIndex(pl)
+	if err != nil {
+		return nil, err
+	}
+	if ci != nil {
+		h.Violations = append(h.Violations, ci.violations()...)
+	}
+
+	return h, nil
+}
+
+// GetViolations returns the partitions not having the desired number of
+// replicas, or having replicas on brokers not allowed or duplicated replicas.
+// Default values are expected to be filled in.
+func GetViolations(pl *model.PartitionList) []Violation {
+	var v []Violation
+	for _, p := range pl.Partitions {
+		if len(toBrokerSet(p.Replicas)) != len(p.Replicas) {
+			v = append(v, Violation{p.Topic, p.Partition, "duplicated replicas"})
+		}
+		if len(p.Replicas) != p.NumReplicas {
+			v = append(v, Violation{p.Topic, p.Partition, fmt.Sprintf("%d replicas instead of %d", len(p.Replicas), p.NumReplicas)})
+		}
+		for _, r := range p.Replicas {
+			if !inBrokerList(p.Brokers, r) {
+				v = append(v, Violation{p.Topic, p.Partition, fmt.Sprintf("replica on disallowed broker %d", r)})
+			}
+		}
+	}
+
+	return v
+}
+
+// prepare returns a copy of the partition list with the default values filled
+// in and the decommissioned brokers removed from the allowed ones
+func prepare(pl *model.PartitionList, cfg RebalanceConfig) (*model.PartitionList, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	state := pl.Copy()
+	if len(state.Partitions) == 0 {
+		return state, nil
+	}
+
+	for _, step := range []StepFunc{ValidateWeights, FillDefaults, DecommissionBrokers} {
+		if _, err := step(state, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	return state, nil
+}
+
+func getBrokerReports(pl *model.PartitionList, cfg RebalanceConfig) []BrokerReport {
+	loads := getClusterLoad(pl, cfg)
+	topics := make(map[model.BrokerID]map[model.TopicName]float64)
+	reports := make(map[model.BrokerID]*BrokerReport)
+	for id, load := range loads {
+		reports[id] = &BrokerReport{ID: id, Load: load}
+		topics[id] = make(map[model.TopicName]float64)
+	}
+
+	lm := cfg.loadModel()
+	for _, p := range pl.Partitions {
+		for idx, r := range p.Replicas {
+			reports[r].Replicas++
+			if idx == 0 {
+				reports[r].Leaders++
+			}
+			topics[r][p.Topic] += lm.replicaLoad(p, idx)
+		}
+	}
+
+	brokers := make([]BrokerReport, 0, len(reports))
+	for id, br := range reports {
+		for topic, load := range topics[id] {
+			br.Topics = append(br.Topics, TopicLoad{Topic: topic, Load: load})
+		}
+		sort.Slice(br.Topics, func(i, j int) bool {
+			if br.Topics[i].Load != br.Topics[j].Load {
+				return br.Topics[i].Load > br.Topics[j].Load
+			}
+			return br.Topics[i].Topic < br.Topics[j].Topic
+		})
+		if len(br.Topics) > reportTopics {
+			br.Topics = br.Topics[:reportTopics]
+		}
+		brokers = append(brokers, *br)
+	}
+	sort.Slice(brokers, func(i, j int) bool { return brokers[i].ID < brokers[j].ID })
+
+	return brokers
+}
+
+func getTopicLoads(pl *model.PartitionList, lm LoadModel) []TopicLoad {
+	loads := make(map[model.TopicName]float64)
+	for _, p := range pl.Partitions {
+		for idx := range p.Replicas {
+			loads[p.Topic] += lm.replicaLoad(p, idx)
+		}
+	}
+
+	topics := make([]TopicLoad, 0, len(loads))
+	for topic, load := range loads {
+		topics = append(topics, TopicLoad{Topic: topic, Load: load})
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Topic < topics[j].Topic })
+
+	return topics
+}
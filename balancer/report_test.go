@@ -0,0 +1,118 @@
+package balancer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+func TestReport(t *testing.T) {
+	pl := wrap([]model.Partition{
+		model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+		model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{1, 2}},
+		model.Partition{Topic: "b", Partition: 1, Replicas: []model.BrokerID{1, 4}, Brokers: []model.BrokerID{1, 2, 3}},
+	})
+
+	cfg := DefaultRebalanceConfig()
+	cfg.Brokers = []model.BrokerID{1, 2, 3, 4}
+	r, err := New(DefaultSteps()...).Report(context.Background(), pl, cfg, 0)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	expected := []BrokerReport{
+		{ID: 1, Load: 6, Replicas: 3, Leaders: 3, Topics: []TopicLoad{{"a", 4}, {"b", 2}}},
+		{ID: 2, Load: 2, Replicas: 2, Leaders: 0, Topics: []TopicLoad{{"a", 2}}},
+		{ID: 3, Load: 0, Replicas: 0, Leaders: 0},
+		{ID: 4, Load: 1, Replicas: 1, Leaders: 0, Topics: []TopicLoad{{"b", 1}}},
+	}
+	if !reflect.DeepEqual(expected, r.Brokers) {
+		t.Errorf("expected %v, got %v", expected, r.Brokers)
+	}
+	if !reflect.DeepEqual([]TopicLoad{{"a", 6}, {"b", 3}}, r.Topics) {
+		t.Errorf("unexpected topics %v", r.Topics)
+	}
+	if u := getUnbalanceBL(getBL(map[model.BrokerID]float64{1: 6, 2: 2, 3: 0, 4: 1})); r.Unbalance != u {
+		t.Errorf("expected unbalance %f, got %f", u, r.Unbalance)
+	}
+	if len(r.Violations) != 1 || r.Violations[0] != (Violation{"b", 1, "replica on disallowed broker 4"}) {
+		t.Errorf("unexpected violations %v", r.Violations)
+	}
+	if !r.Converged || r.MovesNeeded < 2 {
+		t.Errorf("unexpected moves needed %d (converged: %v)", r.MovesNeeded, r.Converged)
+	}
+
+	r, err = New(DefaultSteps()...).Report(context.Background(), pl, cfg, 1)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if r.Converged || r.MovesNeeded != 1 {
+		t.Errorf("unexpected moves needed %d (converged: %v)", r.MovesNeeded, r.Converged)
+	}
+	if !reflect.DeepEqual(pl.Partitions[0].Replicas, []model.BrokerID{1, 2}) || pl.Partitions[0].Weight != 0 {
+		t.Errorf("input modified: %v", pl)
+	}
+}
+
+// oscillatingCluster returns a cluster where, if AllowLeaderRebalancing is
+// set, the moves of leaders and followers undo each other
+func oscillatingCluster() *model.PartitionList {
+	return wrap([]model.Partition{
+		{Topic: "foo1", Partition: 0, Replicas: []model.BrokerID{1, 2}},
+		{Topic: "foo1", Partition: 1, Replicas: []model.BrokerID{1, 3}},
+		{Topic: "foo1", Partition: 2, Replicas: []model.BrokerID{1, 2}},
+		{Topic: "foo1", Partition: 3, Replicas: []model.BrokerID{1, 3}},
+		{Topic: "foo1", Partition: 4, Replicas: []model.BrokerID{1, 3}},
+		{Topic: "foo2", Partition: 0, Replicas: []model.BrokerID{1, 3}},
+		{Topic: "foo2", Partition: 1, Replicas: []model.BrokerID{4, 1}},
+		{Topic: "foo2", Partition: 2, Replicas: []model.BrokerID{1, 2}},
+	})
+}
+
+func TestReportMaxMoves(t *testing.T) {
+	pl := oscillatingCluster()
+	if n := DefaultMaxMoves(pl); n != 16 {
+		t.Errorf("unexpected default max moves %d", n)
+	}
+
+	// the moves of leaders and followers undo each other: planning stops
+	// after as many moves as the replicas
+	cfg := DefaultRebalanceConfig()
+	cfg.AllowLeaderRebalancing = true
+	r, err := New(DefaultSteps()...).Report(context.Background(), pl, cfg, 0)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if r.Converged || r.MovesNeeded != 16 {
+		t.Errorf("unexpected moves needed %d (converged: %v)", r.MovesNeeded, r.Converged)
+	}
+
+	cfg.AllowLeaderRebalancing = false
+	r, err = New(DefaultSteps()...).Report(context.Background(), pl, cfg, 0)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if !r.Converged || r.MovesNeeded != 2 {
+		t.Errorf("unexpected moves needed %d (converged: %v)", r.MovesNeeded, r.Converged)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	pl := wrap([]model.Partition{
+		model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}, NumReplicas: 3},
+		model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1}},
+	})
+
+	h, err := GetHealth(pl, DefaultRebalanceConfig())
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if h.Unbalance != 0 {
+		t.Errorf("unexpected unbalance %f", h.Unbalance)
+	}
+	if len(h.Violations) != 1 || h.Violations[0] != (Violation{"a", 1, "2 replicas instead of 3"}) {
+		t.Errorf("unexpected violations %v", h.Violations)
+	}
+}
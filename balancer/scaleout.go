@@ -0,0 +1,48 @@
+package balancer
+
+import (
+	"sort"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// ScaleOutProgress is the current and target load of a broker being added to
+// the cluster
+type ScaleOutProgress struct {
+	ID     model.BrokerID
+	Load   float64
+	Target float64
+}
+
+// GetScaleOutProgress returns the current and target load of the brokers being
+// added to the cluster, in order from the least to the most loaded. The target
+// load is the average load of all brokers in the cluster.
+func GetScaleOutProgress(pl *model.PartitionList, cfg RebalanceConfig) []ScaleOutProgress {
+	loads := cfg.brokerLoad(pl)
+
+	brokers := toBrokerSet(cfg.brokerList(pl))
+	for _, ids := range [][]model.BrokerID{cfg.Brokers, cfg.ScaleOut} {
+		for _, id := range ids {
+			brokers[id] = struct{}{}
+		}
+	}
+	for _, id := range cfg.Decommission {
+		delete(brokers, id)
+	}
+
+	var total float64
+	for _, load := range getBL(loads) {
+		total += load.Load
+	}
+	target := total / float64(len(brokers))
+
+	progress := make([]ScaleOutProgress, 0, len(cfg.ScaleOut))
+	for _, id := range cfg.ScaleOut {
+		progress = append(progress, ScaleOutProgress{ID: id, Load: loads[id], Target: target})
+	}
+	sort.SliceStable(progress, func(i, j int) bool {
+		return progress[i].Load < progress[j].Load
+	})
+
+	return progress
+}
@@ -0,0 +1,220 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// Scenario is a set of hypothetical changes to a cluster
+type Scenario struct {
+	Version int `json:"version"`
+	// AddBrokers are filled up to the average broker load, as in ScaleOut
+	AddBrokers []model.BrokerID `json:"add_brokers,omitempty"`
+	// RemoveBrokers are drained of all their replicas, as in Decommission
+	RemoveBrokers []model.BrokerID `json:"remove_brokers,omitempty"`
+	// Racks are added to the racks of the brokers in the cluster
+	Racks map[model.BrokerID]string `json:"racks,omitempty"`
+	// Topics change the number of replicas, allowed brokers and weight of the
+	// partitions of the existing topics, as the rules of a Policy
+	Topics    []PolicyRule `json:"topics,omitempty"`
+	NewTopics []NewTopic   `json:"new_topics,omitempty"`
+}
+
+// NewTopic is a topic created in a Scenario
+type NewTopic struct {
+	Topic        model.TopicName `json:"topic"`
+	Partitions   int             `json:"partitions"`
+	NumReplicas  int             `json:"num_replicas"`
+	Weight       float64         `json:"weight,omitempty"` // default: 1.0
+	NumConsumers int             `json:"num_consumers,omitempty"`
+}
+
+// Simulation is the outcome of balancing a cluster after applying a Scenario
+type Simulation struct {
+	Brokers         []BrokerLoadChange `json:"brokers"`
+	UnbalanceBefore float64            `json:"unbalance_before"`
+	UnbalanceAfter  float64            `json:"unbalance_after"`
+	// Moves is the number of reassignments proposed by the balancer.
+	// ReplicasMoved and BytesMoved only account for the replicas added to
+	// existing partitions, as the replicas of new topics don't move any data.
+	Moves         int   `json:"moves"`
+	ReplicasMoved int   `json:"replicas_moved"`
+	BytesMoved    int64 `json:"bytes_moved"`
+	// Converged is false if the balancer was stopped after the maximum number
+	// of reassignments or because the context was done
+	Converged bool `json:"converged"`
+	// Violations are the partitions still violating their constraints
+	Violations []Violation `json:"violations"`
+}
+
+// Simulate applies the scenario to the partition list and invokes the
+// balancer until it proposes no more changes, or at most maxMoves times
+// (DefaultMaxMoves of the partition list resulting from the scenario, if
+// maxMoves is 0), or until the context is done. The partition list passed as
+// argument is not modified.
+func (b *Balancer) Simulate(ctx context.Context, pl *model.PartitionList, cfg RebalanceConfig, sc *Scenario, maxMoves int) (*Simulation, error) {
+	before, err := prepare(pl, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	spl, scfg, err := applyScenario(pl, cfg, sc)
+	if err != nil {
+		return nil, err
+	}
+	scfg.Explain = false
+
+	if maxMoves == 0 {
+		maxMoves = DefaultMaxMoves(spl)
+	}
+	s := &Simulation{}
+	state := NewState(spl)
+	for s.Moves < maxMoves {
+		res, err := b.BalanceState(ctx, state, scfg)
+		if err != nil && ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(res.Changes.Partitions) == 0 {
+			s.Converged = true
+			break
+		}
+		s.Moves += len(res.Changes.Partitions)
+	}
+
+	after, err := prepare(state.PartitionList(), scfg)
+	if err != nil {
+		return nil, err
+	}
+	s.Violations = GetViolations(after)
+
+	initial := make(map[partitionKey]model.Partition, len(spl.Partitions))
+	for _, p := range spl.Partitions {
+		initial[keyOf(p)] = p
+	}
+	for _, p := range after.Partitions {
+		i := initial[keyOf(p)]
+		if len(i.Replicas) == 0 {
+			continue
+		}
+		for _, r := range p.Replicas {
+			if !inBrokerList(i.Replicas, r) {
+				s.ReplicasMoved++
+				s.BytesMoved += p.Size
+			}
+		}
+	}
+
+	lb, la := getClusterLoad(before, cfg), getClusterLoad(after, scfg)
+	if s.UnbalanceBefore, err = cfg.unbalance(getBL(lb)); err != nil {
+		return nil, err
+	}
+	if s.UnbalanceAfter, err = scfg.unbalance(getBL(la)); err != nil {
+		return nil, err
+	}
+	for id := range la {
+		if _, found := lb[id]; !found {
+			lb[id] = 0
+		}
+	}
+	for _, bl := range getBL(lb) {
+		s.Brokers = append(s.Brokers, BrokerLoadChange{ID: bl.ID, Before: bl.Load, After: la[bl.ID]})
+	}
+	sort.Slice(s.Brokers, func(i, j int) bool { return s.Brokers[i].ID < s.Brokers[j].ID })
+
+	return s, nil
+}
+
+// SimulateMaxMoves returns the maximum number of reassignments planned by
+// Simulate if not specified: DefaultMaxMoves of the partition list resulting
+// from the scenario
+func SimulateMaxMoves(pl *model.PartitionList, cfg RebalanceConfig, sc *Scenario) (int, error) {
+	spl, _, err := applyScenario(pl, cfg, sc)
+	if err != nil {
+		return 0, err
+	}
+
+	return DefaultMaxMoves(spl), nil
+}
+
+// applyScenario returns a copy of the partition list and of the configuration
+// with the changes of the scenario applied
+func applyScenario(pl *model.PartitionList, cfg RebalanceConfig, sc *Scenario) (*model.PartitionList, RebalanceConfig, error) {
+	spl := pl.Copy()
+
+	if err := ApplyPolicy(spl, &Policy{Version: 1, Rules: sc.Topics}); err != nil {
+		return nil, cfg, err
+	}
+
+	if len(sc.NewTopics) > 0 {
+		topics := make(map[model.TopicName]struct{})
+		for idx, p := range spl.Partitions {
+			topics[p.Topic] = struct{}{}
+			// partitions either all have weights or none has
+			if p.Weight == 0 {
+				spl.Partitions[idx].Weight = 1.0
+			}
+		}
+		for _, t := range sc.NewTopics {
+			if _, found := topics[t.Topic]; found {
+				return nil, cfg, fmt.Errorf("new topic %s already exists", t.Topic)
+			}
+			if t.Partitions <= 0 || t.NumReplicas <= 0 || t.Weight < 0 || t.NumConsumers < 0 {
+				return nil, cfg, fmt.Errorf("new topic %v has invalid number of partitions, replicas, consumers or weight", t)
+			}
+			topics[t.Topic] = struct{}{}
+			weight := t.Weight
+			if weight == 0 {
+				weight = 1.0
+			}
+			for idx := 0; idx < t.Partitions; idx++ {
+				spl.Partitions = append(spl.Partitions, model.Partition{
+					Topic:        t.Topic,
+					Partition:    model.PartitionID(idx),
+					Replicas:     []model.BrokerID{},
+					Weight:       weight,
+					NumReplicas:  t.NumReplicas,
+					NumConsumers: t.NumConsumers,
+				})
+			}
+		}
+	}
+
+	if len(sc.AddBrokers) > 0 {
+		cfg.ScaleOut = append(append([]model.BrokerID(nil), cfg.ScaleOut...), sc.AddBrokers...)
+		if cfg.Brokers != nil {
+			cfg.Brokers = append(append([]model.BrokerID(nil), cfg.Brokers...), sc.AddBrokers...)
+		}
+	}
+
+	if len(sc.RemoveBrokers) > 0 {
+		cfg.Decommission = append(append([]model.BrokerID(nil), cfg.Decommission...), sc.RemoveBrokers...)
+		if cfg.Brokers != nil {
+			brokers := make([]model.BrokerID, 0, len(cfg.Brokers))
+			for _, id := range cfg.Brokers {
+				if !inBrokerList(sc.RemoveBrokers, id) {
+					brokers = append(brokers, id)
+				}
+			}
+			cfg.Brokers = brokers
+		}
+	}
+
+	if len(sc.Racks) > 0 {
+		racks := make(map[model.BrokerID]string, len(cfg.Racks)+len(sc.Racks))
+		for id, rack := range cfg.Racks {
+			racks[id] = rack
+		}
+		for id, rack := range sc.Racks {
+			racks[id] = rack
+		}
+		cfg.Racks = racks
+	}
+
+	return spl, cfg, nil
+}
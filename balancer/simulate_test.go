@@ -0,0 +1,110 @@
+package balancer
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+func TestSimulate(t *testing.T) {
+	pl := wrap([]model.Partition{
+		model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}, Size: 10},
+		model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1}, Size: 10},
+		model.Partition{Topic: "b", Partition: 1, Replicas: []model.BrokerID{1, 2}, Size: 100},
+		model.Partition{Topic: "b", Partition: 2, Replicas: []model.BrokerID{2, 1}, Size: 100},
+	})
+
+	sc := &Scenario{
+		Version:    1,
+		AddBrokers: []model.BrokerID{3, 4},
+		Topics:     []PolicyRule{{Topic: "a", NumReplicas: 3}},
+		NewTopics:  []NewTopic{{Topic: "c", Partitions: 2, NumReplicas: 2}},
+	}
+	s, err := New(DefaultSteps()...).Simulate(context.Background(), pl, DefaultRebalanceConfig(), sc, 0)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	if !s.Converged || s.Moves < 6 {
+		t.Errorf("unexpected moves %d (converged: %v)", s.Moves, s.Converged)
+	}
+	if len(s.Violations) != 0 {
+		t.Errorf("unexpected violations %v", s.Violations)
+	}
+	if s.UnbalanceBefore != 0 || s.UnbalanceAfter >= 1 {
+		t.Errorf("unexpected unbalance %f -> %f", s.UnbalanceBefore, s.UnbalanceAfter)
+	}
+	if len(s.Brokers) != 4 || s.Brokers[0] != (BrokerLoadChange{ID: 1, Before: 6, After: s.Brokers[0].After}) || s.Brokers[3].Before != 0 || s.Brokers[3].After == 0 {
+		t.Errorf("unexpected brokers %v", s.Brokers)
+	}
+	var total float64
+	for _, b := range s.Brokers {
+		total += b.After
+	}
+	if total != 2*5+2*3+2*3 {
+		t.Errorf("unexpected total load %f", total)
+	}
+	if s.ReplicasMoved < 2 || s.BytesMoved < 20 || s.BytesMoved%10 != 0 {
+		t.Errorf("unexpected replicas moved %d (%d bytes)", s.ReplicasMoved, s.BytesMoved)
+	}
+
+	if !reflect.DeepEqual(pl.Partitions[0].Replicas, []model.BrokerID{1, 2}) || pl.Partitions[0].NumReplicas != 0 || len(pl.Partitions) != 4 {
+		t.Errorf("input modified: %v", pl)
+	}
+}
+
+func TestSimulateMaxMoves(t *testing.T) {
+	pl := oscillatingCluster()
+	cfg := DefaultRebalanceConfig()
+	cfg.AllowLeaderRebalancing = true
+
+	s, err := New(DefaultSteps()...).Simulate(context.Background(), pl, cfg, &Scenario{Version: 1}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if s.Converged || s.Moves != 16 {
+		t.Errorf("unexpected moves %d (converged: %v)", s.Moves, s.Converged)
+	}
+
+	sc := &Scenario{Version: 1, NewTopics: []NewTopic{{Topic: "new", Partitions: 2, NumReplicas: 3}}}
+	maxMoves, err := SimulateMaxMoves(pl, cfg, sc)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if maxMoves != 22 {
+		t.Errorf("unexpected max moves %d", maxMoves)
+	}
+}
+
+func TestSimulateRemoveBrokers(t *testing.T) {
+	pl := wrap([]model.Partition{
+		model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}, Size: 10},
+		model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 3}, Size: 10},
+		model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{3, 1}, Size: 10},
+	})
+
+	cfg := DefaultRebalanceConfig()
+	cfg.Brokers = []model.BrokerID{1, 2, 3}
+	s, err := New(DefaultSteps()...).Simulate(context.Background(), pl, cfg, &Scenario{Version: 1, RemoveBrokers: []model.BrokerID{3}}, 0)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(s.Brokers) != 3 || s.Brokers[2].ID != 3 || s.Brokers[2].After != 0 {
+		t.Errorf("unexpected brokers %v", s.Brokers)
+	}
+	if s.ReplicasMoved != 2 || s.BytesMoved != 20 {
+		t.Errorf("unexpected replicas moved %d (%d bytes)", s.ReplicasMoved, s.BytesMoved)
+	}
+
+	for _, sc := range []*Scenario{
+		{NewTopics: []NewTopic{{Topic: "a", Partitions: 1, NumReplicas: 1}}},
+		{NewTopics: []NewTopic{{Topic: "b", Partitions: 0, NumReplicas: 1}}},
+		{Topics: []PolicyRule{{Topic: "re:(", NumReplicas: 1}}},
+	} {
+		if _, err := New(DefaultSteps()...).Simulate(context.Background(), pl, cfg, sc, 0); err == nil {
+			t.Errorf("%v: expected error", sc)
+		}
+	}
+}
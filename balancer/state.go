@@ -0,0 +1,256 @@
+package balancer
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// State is a partition list together with the index of its partitions, the
+// set of its brokers and their loads, that are kept up to date as changes are
+// applied to it. Invoking Balancer.BalanceState repeatedly on the same State
+// avoids recomputing them from scratch at each invocation: only the loads of
+// the brokers affected by each change are updated.
+type State struct {
+	pl  *model.PartitionList
+	idx map[partitionKey]int
+
+	// the positions in pl of the partitions with a replica on each broker,
+	// in order, and the loads of the brokers according to the load model:
+	// built on first use
+	partitions map[model.BrokerID][]int
+	model      LoadModel
+	loads      map[model.BrokerID]float64
+	brokers    []model.BrokerID
+
+	// the index of the topics matching the affinity rules: built on first
+	// use, and rebuilt if the rules change
+	affinity      *affinityIndex
+	affinityRules []AffinityRule
+
+	// the index of the co-partitioned topics: built on first use, and rebuilt
+	// if the groups change or partitions are appended
+	coPartition       *coPartitionIndex
+	coPartitionGroups []CoPartitionGroup
+
+	// the number of replicas moved from and to each broker by the changes
+	// applied
+	movesFrom map[model.BrokerID]int
+	movesTo   map[model.BrokerID]int
+}
+
+// NewState returns a State containing a copy of the partition list
+func NewState(pl *model.PartitionList) *State {
+	s := &State{
+		pl:        pl.Copy(),
+		idx:       make(map[partitionKey]int, len(pl.Partitions)),
+		movesFrom: make(map[model.BrokerID]int),
+		movesTo:   make(map[model.BrokerID]int),
+	}
+	for i, p := range s.pl.Partitions {
+		s.idx[keyOf(p)] = i
+	}
+
+	return s
+}
+
+// PartitionList returns the partition list of the state. It is modified by
+// the following invocations of Apply and Balancer.BalanceState.
+func (s *State) PartitionList() *model.PartitionList {
+	return s.pl
+}
+
+// Apply replaces the partitions of the state with the same topic and
+// partition number as the ones in changes with (a copy of) the latter.
+// Partitions in changes not present in the state are appended. The replicas
+// moved are counted towards RebalanceConfig.MaxMovesFrom and MaxMovesTo.
+func (s *State) Apply(changes *model.PartitionList) {
+	for _, p := range changes.Copy().Partitions {
+		i, found := s.idx[keyOf(p)]
+		if !found {
+			i = len(s.pl.Partitions)
+			s.idx[keyOf(p)] = i
+			s.pl.Partitions = append(s.pl.Partitions, p)
+			s.coPartition = nil
+			countMoves(nil, p.Replicas, s.movesFrom, s.movesTo)
+			s.update(i, nil)
+			continue
+		}
+		old := s.pl.Partitions[i].Replicas
+		s.pl.Partitions[i] = p
+		countMoves(old, p.Replicas, s.movesFrom, s.movesTo)
+		s.update(i, old)
+	}
+}
+
+// invalidate discards the loads of the brokers: it has to be invoked when the
+// weights of the partitions are modified in place
+func (s *State) invalidate() {
+	s.partitions, s.loads, s.brokers = nil, nil, nil
+}
+
+func (s *State) build() {
+	if s.partitions != nil {
+		return
+	}
+
+	s.partitions = make(map[model.BrokerID][]int)
+	for i, p := range s.pl.Partitions {
+		for idx, r := range p.Replicas {
+			if !inBrokerList(p.Replicas[:idx], r) {
+				s.partitions[r] = append(s.partitions[r], i)
+			}
+		}
+	}
+	s.loads = make(map[model.BrokerID]float64, len(s.partitions))
+	for id := range s.partitions {
+		s.loads[id] = s.load(id)
+	}
+}
+
+// update updates the indices after the replicas of the partition in position
+// i changed from old
+func (s *State) update(i int, old []model.BrokerID) {
+	p := s.pl.Partitions[i]
+	if s.affinity != nil {
+		s.affinity.update(p.Topic, old, p.Replicas)
+	}
+	if s.partitions == nil {
+		return
+	}
+
+	for _, r := range old {
+		if !inBrokerList(p.Replicas, r) {
+			s.remove(r, i)
+		}
+	}
+	for _, r := range p.Replicas {
+		if !inBrokerList(old, r) {
+			s.add(r, i)
+		}
+	}
+	// the load of the leader also depends on the number of replicas
+	for _, ids := range [][]model.BrokerID{old, p.Replicas} {
+		for _, id := range ids {
+			if _, found := s.partitions[id]; found {
+				s.loads[id] = s.load(id)
+			} else {
+				delete(s.loads, id)
+			}
+		}
+	}
+}
+
+func (s *State) add(id model.BrokerID, i int) {
+	pos := s.partitions[id]
+	j := sort.SearchInts(pos, i)
+	if j < len(pos) && pos[j] == i {
+		return
+	}
+	if len(pos) == 0 {
+		s.brokers = nil
+	}
+	pos = append(pos, 0)
+	copy(pos[j+1:], pos[j:])
+	pos[j] = i
+	s.partitions[id] = pos
+}
+
+func (s *State) remove(id model.BrokerID, i int) {
+	pos := s.partitions[id]
+	j := sort.SearchInts(pos, i)
+	if j == len(pos) || pos[j] != i {
+		return
+	}
+	pos = append(pos[:j], pos[j+1:]...)
+	if len(pos) == 0 {
+		delete(s.partitions, id)
+		s.brokers = nil
+		return
+	}
+	s.partitions[id] = pos
+}
+
+// load computes the load of the broker adding the contributions of its
+// replicas in the same order as getBrokerLoad, so that the result is the same
+// down to the last bit
+func (s *State) load(id model.BrokerID) float64 {
+	var load float64
+	for _, i := range s.partitions[id] {
+		p := s.pl.Partitions[i]
+		for idx, r := range p.Replicas {
+			if r != id {
+				continue
+			}
+			load += s.model.replicaLoad(p, idx)
+		}
+	}
+
+	return load
+}
+
+// brokerLoad returns a copy of the loads of the brokers according to the load
+// model
+func (s *State) brokerLoad(lm LoadModel) map[model.BrokerID]float64 {
+	if s.partitions != nil && s.model != lm {
+		s.invalidate()
+	}
+	s.model = lm
+	s.build()
+	loads := make(map[model.BrokerID]float64, len(s.loads))
+	for id, load := range s.loads {
+		loads[id] = load
+	}
+
+	return loads
+}
+
+// affinityIndex returns the index of the topics matching the affinity rules
+func (s *State) affinityIndex(rules []AffinityRule) (*affinityIndex, error) {
+	if s.affinity != nil && reflect.DeepEqual(rules, s.affinityRules) {
+		return s.affinity, nil
+	}
+
+	ai, err := newAffinityIndex(s.pl, rules)
+	if err != nil {
+		return nil, err
+	}
+	s.affinity, s.affinityRules = ai, append([]AffinityRule(nil), rules...)
+
+	return ai, nil
+}
+
+// coPartitionIndex returns the index of the co-partitioned topics
+func (s *State) coPartitionIndex(groups []CoPartitionGroup) (*coPartitionIndex, error) {
+	if s.coPartition != nil && reflect.DeepEqual(groups, s.coPartitionGroups) {
+		return s.coPartition, nil
+	}
+
+	ci, err := newCoPartitionIndex(s.pl, groups)
+	if err != nil {
+		return nil, err
+	}
+	s.coPartition, s.coPartitionGroups = ci, make([]CoPartitionGroup, len(groups))
+	for idx, g := range groups {
+		g.Topics = append([]string(nil), g.Topics...)
+		s.coPartitionGroups[idx] = g
+	}
+
+	return ci, nil
+}
+
+// brokerList returns a copy of the sorted list of the brokers hosting
+// replicas
+func (s *State) brokerList() []model.BrokerID {
+	s.build()
+	if s.brokers == nil {
+		s.brokers = make([]model.BrokerID, 0, len(s.partitions))
+		for id := range s.partitions {
+			s.brokers = append(s.brokers, id)
+		}
+		sort.Sort(byBrokerID(s.brokers))
+	}
+
+	return append([]model.BrokerID(nil), s.brokers...)
+}
@@ -0,0 +1,141 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+func TestStateApply(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	pl := randomCluster(rng, 10, 500)
+	s := NewState(pl)
+
+	check := func(step int) {
+		if loads, expected := s.brokerLoad(DefaultLoadModel()), getBrokerLoad(s.pl, DefaultLoadModel()); !reflect.DeepEqual(loads, expected) {
+			t.Fatalf("step %d: unexpected loads %v, expected %v", step, loads, expected)
+		}
+		if brokers, expected := s.brokerList(), getBrokerList(s.pl); !reflect.DeepEqual(brokers, expected) {
+			t.Fatalf("step %d: unexpected brokers %v, expected %v", step, brokers, expected)
+		}
+	}
+
+	check(0)
+	for step := 1; step <= 1000; step++ {
+		var p model.Partition
+		if rng.Intn(20) == 0 {
+			p = model.Partition{Topic: "new", Partition: model.PartitionID(step), Weight: float64(1 + rng.Intn(10))}
+		} else {
+			p = s.pl.Partitions[rng.Intn(len(s.pl.Partitions))]
+			p.NumConsumers = rng.Intn(3)
+		}
+		// brokers 11 and 12 are added and removed from the cluster
+		p.Replicas = nil
+		for _, id := range rng.Perm(12)[:rng.Intn(4)] {
+			p.Replicas = append(p.Replicas, model.BrokerID(id+1))
+		}
+		s.Apply(singlepl(p))
+		check(step)
+	}
+
+	if len(s.pl.Partitions) == len(pl.Partitions) || reflect.DeepEqual(s.pl, pl) {
+		t.Fatalf("unexpected partitions")
+	}
+	expected := pl.Copy()
+	for _, p := range s.pl.Partitions {
+		expected = Apply(expected, singlepl(p))
+	}
+	if !reflect.DeepEqual(s.pl, expected) {
+		t.Fatalf("unexpected partitions %v, expected %v", s.pl, expected)
+	}
+}
+
+func TestBalanceStateMatchesBalance(t *testing.T) {
+	b := New(DefaultSteps()...)
+
+	for seed := int64(0); seed < 20; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		brokers := 3 + rng.Intn(10)
+		pl := randomCluster(rng, brokers, 1+rng.Intn(300))
+		if seed%2 == 0 {
+			for idx := range pl.Partitions {
+				pl.Partitions[idx].Weight = 0
+			}
+		}
+		cfg := DefaultRebalanceConfig()
+		cfg.AllowLeaderRebalancing = seed%2 == 0
+		cfg.Explain = seed%3 == 0
+		switch seed % 4 {
+		case 1:
+			cfg.Decommission = []model.BrokerID{1}
+		case 2:
+			cfg.ScaleOut = []model.BrokerID{model.BrokerID(brokers + 1)}
+		case 3:
+			cfg.Racks = randomRacks(rng, brokers)
+		}
+
+		s, state := NewState(pl), pl
+		for step := 0; step < 50; step++ {
+			res, err := b.BalanceState(context.Background(), s, cfg)
+			eres, eerr := b.Balance(state, cfg)
+			if fmt.Sprint(err) != fmt.Sprint(eerr) {
+				t.Fatalf("seed %d step %d: got error %v, expected %v", seed, step, err, eerr)
+			}
+			if err != nil {
+				break
+			}
+			if !reflect.DeepEqual(res, eres) {
+				t.Fatalf("seed %d step %d: got %v, expected %v", seed, step, res, eres)
+			}
+			if len(res.Changes.Partitions) == 0 {
+				break
+			}
+			state = eres.State
+		}
+	}
+}
+
+func benchmarkPlan(bench *testing.B, brokers, partitions int, state bool) {
+	pl := randomCluster(rand.New(rand.NewSource(1)), brokers, partitions)
+	cfg := DefaultRebalanceConfig()
+	cfg.Parallelism = 1
+	b := New(DefaultSteps()...)
+
+	bench.ResetTimer()
+	for i := 0; i < bench.N; i++ {
+		s, cur := NewState(pl), pl
+		for moves := 0; moves < 20; moves++ {
+			var res *Result
+			var err error
+			if state {
+				res, err = b.BalanceState(context.Background(), s, cfg)
+			} else {
+				res, err = b.Balance(cur, cfg)
+			}
+			if err != nil {
+				bench.Fatalf("unexpected error %s", err)
+			}
+			cur = res.State
+		}
+	}
+}
+
+func BenchmarkPlan(bench *testing.B) {
+	for _, s := range benchmarkSizes {
+		bench.Run(fmt.Sprintf("%dx%d", s.brokers, s.partitions), func(bench *testing.B) {
+			benchmarkPlan(bench, s.brokers, s.partitions, true)
+		})
+	}
+}
+
+func BenchmarkPlanWithoutState(bench *testing.B) {
+	for _, s := range benchmarkSizes {
+		bench.Run(fmt.Sprintf("%dx%d", s.brokers, s.partitions), func(bench *testing.B) {
+			benchmarkPlan(bench, s.brokers, s.partitions, false)
+		})
+	}
+}
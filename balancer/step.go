@@ -0,0 +1,112 @@
+package balancer
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// Step is a step of the rebalancing pipeline. Steps are executed in order and
+// the first one proposing changes stops the pipeline.
+type Step interface {
+	// Name returns the name used to refer to the step
+	Name() string
+	// Apply returns the partitions to reassign, or nil if the step has no
+	// change to propose. The replicas and weights of the partitions in pl must
+	// not be modified.
+	Apply(pl *model.PartitionList, cfg RebalanceConfig) (*model.PartitionList, error)
+}
+
+// StepFunc is the signature of the functions implementing the built-in steps
+type StepFunc func(*model.PartitionList, RebalanceConfig) (*model.PartitionList, error)
+
+type step struct {
+	name string
+	fn   StepFunc
+}
+
+func (s step) Name() string {
+	return s.name
+}
+
+func (s step) Apply(pl *model.PartitionList, cfg RebalanceConfig) (*model.PartitionList, error) {
+	return s.fn(pl, cfg)
+}
+
+// NewStep returns a Step with the specified name that calls fn
+func NewStep(name string, fn StepFunc) Step {
+	return step{name: name, fn: fn}
+}
+
+// DefaultSteps returns the built-in steps, in the default order
+func DefaultSteps() []Step {
+	return []Step{
+		NewStep("ValidateWeights", ValidateWeights),
+		NewStep("ValidateReplicas", ValidateReplicas),
+		NewStep("FillDefaults", FillDefaults),
+		NewStep("PinPartitions", PinPartitions),
+		NewStep("ValidateAffinities", ValidateAffinities),
+		NewStep("DecommissionBrokers", DecommissionBrokers),
+		NewStep("RemoveExtraReplicas", RemoveExtraReplicas),
+		NewStep("AddMissingReplicas", AddMissingReplicas),
+		NewStep("MoveDisallowedLeaders", MoveDisallowedLeaders),
+		NewStep("MoveDisallowedReplicas", MoveDisallowedReplicas),
+		NewStep("AlignCoPartitioned", AlignCoPartitioned),
+		NewStep("ScaleOut", ScaleOut),
+		NewStep("MoveLeaders", MoveLeaders),
+		NewStep("MoveNonLeaders", MoveNonLeaders),
+	}
+}
+
+var (
+	registryLock sync.RWMutex
+	registry     = make(map[string]Step)
+)
+
+func init() {
+	for _, s := range DefaultSteps() {
+		RegisterStep(s)
+	}
+}
+
+// RegisterStep makes a step available by name through LookupStep, e.g. to
+// allow including it in the pipeline from the command line. It panics if a
+// step with the same name is already registered.
+func RegisterStep(s Step) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+
+	if _, found := registry[s.Name()]; found {
+		panic(fmt.Sprintf("step %s already registered", s.Name()))
+	}
+	registry[s.Name()] = s
+}
+
+// LookupStep returns the registered step with the specified name
+func LookupStep(name string) (Step, error) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	s, found := registry[name]
+	if !found {
+		return nil, fmt.Errorf("unknown step %s", name)
+	}
+
+	return s, nil
+}
+
+// RegisteredSteps returns the names of the registered steps, sorted by name
+func RegisteredSteps() []string {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,84 @@
+package balancer
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+func TestCustomPipeline(t *testing.T) {
+	// pin all partitions with a replica on broker 2
+	maintenance := NewStep("Maintenance", func(pl *model.PartitionList, _ RebalanceConfig) (*model.PartitionList, error) {
+		for idx, p := range pl.Partitions {
+			if inBrokerList(p.Replicas, 2) {
+				pl.Partitions[idx].Pinned = true
+			}
+		}
+		return nil, nil
+	})
+
+	var steps []Step
+	for _, s := range DefaultSteps() {
+		steps = append(steps, s)
+		if s.Name() == "PinPartitions" {
+			steps = append(steps, maintenance)
+		}
+	}
+	b := New(steps...)
+
+	pl := wrap([]model.Partition{
+		model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2, 3}, Weight: 1.0},
+		model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 1, 4}, Weight: 1.0},
+		model.Partition{Topic: "a", Partition: 3, Replicas: []model.BrokerID{1, 2, 5}, Weight: 1.0},
+	})
+	res, err := New(DefaultSteps()...).Balance(pl, DefaultRebalanceConfig())
+	if err != nil || len(res.Changes.Partitions) == 0 {
+		t.Fatalf("expected changes, got %v, error %v", res, err)
+	}
+
+	res, err = b.Balance(pl, DefaultRebalanceConfig())
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(res.Changes.Partitions) != 0 {
+		t.Errorf("unexpected changes %v", res.Changes)
+	}
+
+	if len(b.Steps()) != len(DefaultSteps())+1 {
+		t.Errorf("unexpected steps %v", b.Steps())
+	}
+}
+
+func TestStepRegistry(t *testing.T) {
+	s, err := LookupStep("MoveLeaders")
+	if err != nil || s.Name() != "MoveLeaders" {
+		t.Errorf("unexpected step %v, error %v", s, err)
+	}
+
+	if _, err := LookupStep("TestStepRegistry"); err == nil {
+		t.Errorf("expected error")
+	}
+
+	RegisterStep(NewStep("TestStepRegistry", MoveLeaders))
+	if _, err := LookupStep("TestStepRegistry"); err != nil {
+		t.Errorf("unexpected error %s", err)
+	}
+
+	var names []string
+	for _, name := range RegisteredSteps() {
+		if name == "TestStepRegistry" || name == "ValidateWeights" {
+			names = append(names, name)
+		}
+	}
+	if !reflect.DeepEqual(names, []string{"TestStepRegistry", "ValidateWeights"}) {
+		t.Errorf("unexpected registered steps %v", RegisteredSteps())
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic")
+		}
+	}()
+	RegisterStep(NewStep("MoveLeaders", MoveLeaders))
+}
@@ -0,0 +1,667 @@
+package balancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// ValidateWeights make sure that either all partitions have an explicit,
+// strictly positive weight or that all partitions have no weight, and that
+// the measured bytes in and out are known if the load model uses them
+func ValidateWeights(pl *model.PartitionList, cfg RebalanceConfig) (*model.PartitionList, error) {
+	hasWeights := pl.Partitions[0].Weight != 0
+	hasBytes := false
+
+	for _, p := range pl.Partitions {
+		if hasWeights && p.Weight == 0 {
+			return nil, fmt.Errorf("partition %v has no weight", p)
+		}
+		if !hasWeights && p.Weight != 0 {
+			return nil, fmt.Errorf("partition %v has no weight", pl.Partitions[0])
+		}
+		if p.Weight < 0 {
+			return nil, fmt.Errorf("partition %v has negative weight", p)
+		}
+		if p.BytesIn < 0 || p.BytesOut < 0 {
+			return nil, fmt.Errorf("partition %v has negative bytes in or out", p)
+		}
+		hasBytes = hasBytes || p.BytesIn != 0 || p.BytesOut != 0
+	}
+
+	if cfg.loadModel().Measured && !hasBytes {
+		return nil, fmt.Errorf("no partition has measured bytes in or out")
+	}
+
+	return nil, nil
+}
+
+// ValidateReplicas checks that partitions don't have more than one replica per
+// broker
+func ValidateReplicas(pl *model.PartitionList, _ RebalanceConfig) (*model.PartitionList, error) {
+	for _, p := range pl.Partitions {
+		replicaset := toBrokerSet(p.Replicas)
+		if len(replicaset) != len(p.Replicas) {
+			return nil, fmt.Errorf("partition %v has duplicated replicas", p)
+		}
+	}
+
+	return nil, nil
+}
+
+// FillDefaults fills in default values for Weight, Brokers and NumReplicas
+func FillDefaults(pl *model.PartitionList, cfg RebalanceConfig) (*model.PartitionList, error) {
+	// if the weights are 0, set them to 1
+	if pl.Partitions[0].Weight == 0 {
+		for idx := range pl.Partitions {
+			pl.Partitions[idx].Weight = 1.0
+		}
+		if cfg.state != nil && cfg.state.pl == pl {
+			cfg.state.invalidate()
+		}
+	}
+
+	// if the set of candidate brokers is empty, fill it with the default set
+	brokers := cfg.Brokers
+	if brokers == nil {
+		brokers = cfg.brokerList(pl)
+		for _, id := range cfg.ScaleOut {
+			if !inBrokerList(brokers, id) {
+				brokers = append(brokers, id)
+			}
+		}
+		sort.Sort(byBrokerID(brokers))
+	}
+	for idx := range pl.Partitions {
+		if pl.Partitions[idx].Brokers == nil {
+			pl.Partitions[idx].Brokers = brokers
+		}
+	}
+
+	// if the desired number of replicas is 0, fill it with the current number
+	for idx := range pl.Partitions {
+		if pl.Partitions[idx].NumReplicas == 0 {
+			pl.Partitions[idx].NumReplicas = len(pl.Partitions[idx].Replicas)
+		}
+	}
+
+	return nil, nil
+}
+
+// PinPartitions pins the partitions of the topics not eligible for rebalancing
+// according to the Include and Exclude patterns. Pinned partitions contribute
+// to the load of their brokers but are never changed by the following steps.
+func PinPartitions(pl *model.PartitionList, cfg RebalanceConfig) (*model.PartitionList, error) {
+	include, err := compileTopicPatterns(cfg.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := compileTopicPatterns(cfg.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx, p := range pl.Partitions {
+		if len(include) > 0 && !matchTopic(include, p.Topic) {
+			pl.Partitions[idx].Pinned = true
+		}
+		if matchTopic(exclude, p.Topic) {
+			pl.Partitions[idx].Pinned = true
+		}
+	}
+
+	return nil, nil
+}
+
+// DecommissionBrokers removes the brokers being decommissioned from the set of
+// allowed brokers of all partitions
+func DecommissionBrokers(pl *model.PartitionList, cfg RebalanceConfig) (*model.PartitionList, error) {
+	if len(cfg.Decommission) == 0 {
+		return nil, nil
+	}
+
+	for idx, p := range pl.Partitions {
+		brokers := make([]model.BrokerID, 0, len(p.Brokers))
+		for _, b := range p.Brokers {
+			if !inBrokerList(cfg.Decommission, b) {
+				brokers = append(brokers, b)
+			}
+		}
+		if len(brokers) != len(p.Brokers) {
+			pl.Partitions[idx].Brokers = brokers
+		}
+	}
+
+	return nil, nil
+}
+
+// RemoveExtraReplicas removes replicas from partitions having lower NumReplicas
+// than the current number of replicas, preferring the ones whose removal
+// doesn't violate the hard affinity rules. Partitions whose replicas are all
+// on brokers that reached MaxMovesFrom are skipped.
+func RemoveExtraReplicas(pl *model.PartitionList, cfg RebalanceConfig) (*model.PartitionList, error) {
+	loads := cfg.brokerLoad(pl)
+	ai, err := cfg.affinityIndex(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range pl.Partitions {
+		if p.Pinned || p.NumReplicas >= len(p.Replicas) {
+			continue
+		}
+
+		brokersByLoad := getBrokerListByLoad(loads, p.Brokers)
+		cb, ca, capped := model.BrokerID(-1), 0, false
+		for _, b := range brokersByLoad {
+			if !inBrokerList(p.Replicas, b) {
+				continue
+			}
+			if cfg.capped(b, -1, 1) {
+				capped = true
+				continue
+			}
+			a, _ := ai.delta(p.Topic, b, -1)
+			if cb == -1 || a < ca {
+				cb, ca = b, a
+			}
+		}
+		if cb != -1 {
+			return replacepl(p, cb, -1), nil
+		}
+		if capped {
+			continue
+		}
+
+		return nil, fmt.Errorf("partition %v unable to pick replica to remove", p)
+	}
+
+	return nil, nil
+}
+
+// AddMissingReplicas adds replicas to partitions having NumReplicas greater
+// than the current number of replicas, preferring the brokers where they
+// don't violate the hard affinity rules and then the ones in racks not
+// hosting other replicas of the same partition. Brokers that reached
+// MaxMovesTo are skipped.
+func AddMissingReplicas(pl *model.PartitionList, cfg RebalanceConfig) (*model.PartitionList, error) {
+	loads := cfg.brokerLoad(pl)
+	ai, err := cfg.affinityIndex(pl)
+	if err != nil {
+		return nil, err
+	}
+	// add missing replicas
+	for _, p := range pl.Partitions {
+		if p.Pinned || p.NumReplicas <= len(p.Replicas) {
+			continue
+		}
+
+		brokersByLoad := getBrokerListByLoad(loads, p.Brokers)
+		cb, ca, cc, capped := model.BrokerID(-1), 0, 0, false
+		for idx := len(brokersByLoad) - 1; idx >= 0; idx-- {
+			b := brokersByLoad[idx]
+			if inBrokerList(p.Replicas, b) {
+				continue
+			}
+			if cfg.capped(-1, b, 1) {
+				capped = true
+				continue
+			}
+			a, _ := ai.delta(p.Topic, -1, b)
+			c := rackConflicts(p, cfg.Racks, -1, b)
+			if cb == -1 || a < ca || a == ca && c < cc {
+				cb, ca, cc = b, a, c
+			}
+		}
+		if cb != -1 {
+			return addpl(p, cb), nil
+		}
+		if capped {
+			continue
+		}
+
+		return nil, fmt.Errorf("partition %v unable to pick replica to add", p)
+	}
+
+	return nil, nil
+}
+
+// MoveDisallowedLeaders makes the least loaded allowed follower the leader of
+// the partitions whose leader is on a broker being decommissioned, so that
+// leadership is moved away before the replica itself
+func MoveDisallowedLeaders(pl *model.PartitionList, cfg RebalanceConfig) (*model.PartitionList, error) {
+	if len(cfg.Decommission) == 0 {
+		return nil, nil
+	}
+
+	loads := cfg.brokerLoad(pl)
+
+	for _, p := range pl.Partitions {
+		if p.Pinned || len(p.Replicas) < 2 || !inBrokerList(cfg.Decommission, p.Replicas[0]) {
+			continue
+		}
+
+		for _, b := range getBrokerListByLoad(loads, p.Replicas[1:]) {
+			if inBrokerList(p.Brokers, b) {
+				return leaderpl(p, b), nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// MoveDisallowedReplicas moves replicas from non-allowed brokers to the least
+// loaded ones, preferring brokers where they don't violate the hard affinity
+// rules and then brokers in racks not hosting other replicas of the same
+// partition. Moves exceeding MaxMovesFrom or MaxMovesTo are skipped.
+func MoveDisallowedReplicas(pl *model.PartitionList, cfg RebalanceConfig) (*model.PartitionList, error) {
+	loads := cfg.brokerLoad(pl)
+	bl := getBL(loads)
+	ai, err := cfg.affinityIndex(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range pl.Partitions {
+		if p.Pinned {
+			continue
+		}
+
+		brokersByLoad := getBrokerListByLoadBL(bl, p.Brokers)
+
+		for _, id := range p.Replicas {
+			if inBrokerList(brokersByLoad, id) {
+				continue
+			}
+
+			cb, ca, cc, capped := model.BrokerID(-1), 0, 0, false
+			for _, b := range brokersByLoad {
+				if inBrokerList(p.Replicas, b) {
+					continue
+				}
+				if cfg.capped(id, b, 1) {
+					capped = true
+					continue
+				}
+				a, _ := ai.delta(p.Topic, id, b)
+				c := rackConflicts(p, cfg.Racks, id, b)
+				if cb == -1 || a < ca || a == ca && c < cc {
+					cb, ca, cc = b, a, c
+				}
+			}
+			if cb != -1 {
+				return replacepl(p, id, cb), nil
+			}
+			if capped {
+				continue
+			}
+
+			return nil, fmt.Errorf("partition %v unable to pick replica to replace broker %d", p, id)
+		}
+	}
+
+	return nil, nil
+}
+
+// ScaleOut moves replicas from overloaded brokers to the brokers being added
+// to the cluster, until they reach the average broker load. The replicas
+// yielding the largest load transfer per byte moved are picked first: this
+// favors moving leaders, as they carry more load than followers, if
+// AllowLeaderRebalancing is set (otherwise only followers are moved). The
+// partitions of co-partitioned topics are left to MoveLeaders and
+// MoveNonLeaders, that keep them aligned.
+func ScaleOut(pl *model.PartitionList, cfg RebalanceConfig) (*model.PartitionList, error) {
+	if len(cfg.ScaleOut) == 0 {
+		return nil, nil
+	}
+
+	loads := cfg.brokerLoad(pl)
+	targets := GetScaleOutProgress(pl, cfg)
+	lm := cfg.loadModel()
+	ai, err := cfg.affinityIndex(pl)
+	if err != nil {
+		return nil, err
+	}
+	ci, err := cfg.coPartitionIndex(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, target := range targets {
+		deficit := target.Target - target.Load
+		if deficit <= 0 {
+			continue
+		}
+
+		var cp model.Partition
+		var cr model.BrokerID
+		var cs float64
+		for _, p := range pl.Partitions {
+			if p.Pinned || p.NumReplicas < cfg.MinReplicasForRebalancing || ci.unit(p) != nil {
+				continue
+			}
+			if !inBrokerList(p.Brokers, target.ID) || inBrokerList(p.Replicas, target.ID) {
+				continue
+			}
+
+			for idx, r := range p.Replicas {
+				if idx == 0 && !cfg.AllowLeaderRebalancing {
+					continue
+				}
+				if inBrokerList(cfg.ScaleOut, r) || cfg.capped(r, target.ID, 1) {
+					continue
+				}
+				gain := lm.replicaLoad(p, idx)
+				if gain > deficit || loads[r]-gain < target.Target {
+					continue
+				}
+				if cfg.Racks != nil && rackConflicts(p, cfg.Racks, r, target.ID) > rackConflicts(p, cfg.Racks, r, r) {
+					continue
+				}
+				if a, _ := ai.delta(p.Topic, r, target.ID); a > 0 {
+					continue
+				}
+				score := gain / float64(p.Size+1)
+				if score > cs {
+					cp, cr, cs = p, r, score
+				}
+			}
+		}
+
+		if cs > 0 {
+			return replacepl(cp, cr, target.ID), nil
+		}
+	}
+
+	return nil, nil
+}
+
+// exactKey identifies the move of weight w from the broker in position from
+// in bl to the one in position to
+type exactKey struct {
+	from, to int
+	w        float64
+}
+
+// minimum number of partitions evaluated by each goroutine in move
+const minShardPartitions = 128
+
+// moveShard is the best move found among a shard of the partitions
+type moveShard struct {
+	found      bool
+	u          float64
+	rank       uint64
+	p          model.Partition
+	r, b       model.BrokerID
+	candidates *candidateList
+	err        error
+}
+
+// compare returns a negative number if a move yielding unbalance u is better
+// than the best move of the shard, 0 if it is a tie to break with the rank of
+// the moves, or a positive number otherwise
+func (s *moveShard) compare(cfg RebalanceConfig, u float64) int {
+	switch {
+	case u < s.u:
+		return -1
+	case s.found && u == s.u && cfg.Seed != 0:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// moveRank is the pseudo-random rank used to break the ties between moves
+func moveRank(seed int64, p model.Partition, r, b model.BrokerID) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d\x00%s\x00%d\x00%d\x00%d", seed, p.Topic, p.Partition, r, b)
+	return h.Sum64()
+}
+
+func move(pl *model.PartitionList, cfg RebalanceConfig, leaders bool) (*model.PartitionList, error) {
+	bl := getBL(getClusterLoad(pl, cfg))
+	su, err := cfg.unbalance(bl)
+	if err != nil {
+		return nil, err
+	}
+	ai, err := cfg.affinityIndex(pl)
+	if err != nil {
+		return nil, err
+	}
+	ci, err := cfg.coPartitionIndex(pl)
+	if err != nil {
+		return nil, err
+	}
+
+	// the partitions are split in contiguous shards evaluated concurrently:
+	// merging the best moves of the shards in order, and preferring the
+	// earlier one in case of ties, yields the same move found by evaluating
+	// all partitions sequentially
+	n := cfg.parallelism()
+	if max := (len(pl.Partitions) + minShardPartitions - 1) / minShardPartitions; n > max {
+		n = max
+	}
+	if n < 1 {
+		n = 1
+	}
+	shards := make([]moveShard, n)
+	var wg sync.WaitGroup
+	for i := range shards {
+		lo, hi := i*len(pl.Partitions)/n, (i+1)*len(pl.Partitions)/n
+		if cfg.candidates != nil {
+			shards[i].candidates = &candidateList{}
+		}
+		sbl := bl
+		if i < n-1 {
+			sbl = append([]brokerLoad(nil), bl...)
+			wg.Add(1)
+			go func(s *moveShard) {
+				defer wg.Done()
+				s.evaluate(pl.Partitions[lo:hi], cfg, leaders, sbl, su, ai, ci)
+			}(&shards[i])
+		} else {
+			shards[i].evaluate(pl.Partitions[lo:hi], cfg, leaders, sbl, su, ai, ci)
+		}
+	}
+	wg.Wait()
+
+	if cfg.candidates != nil {
+		cfg.candidates.reset()
+	}
+	best := &moveShard{u: su}
+	for i, s := range shards {
+		if s.err != nil {
+			return nil, s.err
+		}
+		if c := best.compare(cfg, s.u); s.found && (c < 0 || c == 0 && s.rank < best.rank) {
+			best = &shards[i]
+		}
+		if cfg.candidates != nil {
+			for _, c := range s.candidates.candidates {
+				cfg.candidates.add(c)
+			}
+		}
+	}
+
+	if best.found && best.u < su-cfg.MinUnbalance {
+		if cfg.candidates != nil {
+			cfg.candidates.choose(Candidate{Topic: best.p.Topic, Partition: best.p.Partition, From: best.r, To: best.b, Unbalance: best.u})
+		}
+		changes := replacepl(best.p, best.r, best.b)
+		comoved, _ := ci.comoved(best.p, leaders)
+		for _, m := range comoved {
+			changes.Partitions = append(changes.Partitions, replacepl(m, best.r, best.b).Partitions...)
+		}
+		return changes, nil
+	}
+
+	return nil, nil
+}
+
+// evaluate finds the move of a replica of the partitions that yields the
+// lowest unbalance, plus the penalties of the soft affinity rules it
+// violates, if lower than su. Moves violating hard affinity rules are
+// skipped. The replicas of the aligned co-partitioned partitions are moved
+// together with the one of the first partition of their unit. The loads in
+// bl are modified during the evaluation and restored before returning. If
+// the context is done, the evaluation stops and the best move found so far
+// is kept.
+func (s *moveShard) evaluate(partitions []model.Partition, cfg RebalanceConfig, leaders bool, bl []brokerLoad, su float64, ai *affinityIndex, ci *coPartitionIndex) {
+	s.u = su
+
+	// with the default metric, the unbalance of a candidate is first
+	// estimated in O(1) (see unbalanceIndex): only when the estimate is too
+	// close to the unbalance of the best candidate to tell which one is
+	// lower, or when it is lower, the exact unbalance is computed, so that the
+	// candidates chosen are the same as if the exact unbalance was computed
+	// for all of them
+	ui := newUnbalanceIndex(bl)
+	unbalance, err := cfg.unbalanceFunc()
+	if err != nil {
+		s.err = err
+		return
+	}
+	lm := cfg.loadModel()
+	estimate := s.candidates == nil && (cfg.Metric == "" || cfg.Metric == DefaultMetric)
+	// many candidates move the same load between the same brokers
+	exact := make(map[exactKey]float64)
+	allowed := make([]bool, len(bl))
+	replica := make([]bool, len(bl))
+	capped := cfg.MaxMovesFrom > 0 || cfg.MaxMovesTo > 0
+
+	done := cfg.Context().Done()
+
+	for _, p := range partitions {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		if p.Pinned || p.NumReplicas < cfg.MinReplicasForRebalancing {
+			continue
+		}
+		comoved, movable := ci.comoved(p, leaders)
+		if !movable {
+			continue
+		}
+
+		replicas := p.Replicas[1:]
+		if leaders {
+			replicas = p.Replicas[0:1]
+		}
+
+		for _, b := range p.Brokers {
+			if idx, found := ui.idx[b]; found {
+				allowed[idx] = true
+			}
+		}
+		for _, r := range p.Replicas {
+			if idx, found := ui.idx[r]; found {
+				replica[idx] = true
+			}
+		}
+		for _, m := range comoved {
+			for idx, b := range bl {
+				allowed[idx] = allowed[idx] && inBrokerList(m.Brokers, b.ID)
+			}
+			for _, r := range m.Replicas {
+				if idx, found := ui.idx[r]; found {
+					replica[idx] = true
+				}
+			}
+		}
+
+		for _, r := range replicas {
+			ridx, found := ui.idx[r]
+			if !found {
+				s.err = fmt.Errorf("assertion failed: replica %d not in broker loads %v", r, bl)
+				return
+			}
+			if capped && cfg.capped(r, -1, 1+len(comoved)) {
+				continue
+			}
+			w := lm.moveLoad(p)
+			for _, m := range comoved {
+				w += lm.moveLoad(m)
+			}
+			rload := bl[ridx].Load
+			bl[ridx].Load -= w
+
+			for idx, b := range bl {
+				if !allowed[idx] || replica[idx] || capped && cfg.capped(-1, b.ID, 1+len(comoved)) {
+					continue
+				}
+				if cfg.Racks != nil && rackConflicts(p, cfg.Racks, r, b.ID) > rackConflicts(p, cfg.Racks, r, r) {
+					continue
+				}
+				if cfg.Racks != nil && !comovedRacks(comoved, cfg.Racks, r, b.ID) {
+					continue
+				}
+				a, penalty := ai.delta(p.Topic, r, b.ID)
+				for _, m := range comoved {
+					ma, mpenalty := ai.delta(m.Topic, r, b.ID)
+					a, penalty = a+ma, penalty+mpenalty
+				}
+				if a > 0 {
+					continue
+				}
+
+				if estimate {
+					eu := ui.estimate(rload, b.Load, w) + penalty
+					if eu > s.u+ui.tolerance(s.u) {
+						continue
+					}
+				}
+
+				k := exactKey{ridx, idx, w}
+				u, found := exact[k]
+				if !found {
+					bload := bl[idx].Load
+					bl[idx].Load += w
+					u = unbalance(bl)
+					bl[idx].Load = bload
+					exact[k] = u
+				}
+				u += penalty
+				c := s.compare(cfg, u)
+				var rank uint64
+				if c <= 0 && cfg.Seed != 0 {
+					rank = moveRank(cfg.Seed, p, r, b.ID)
+				}
+				if c < 0 || c == 0 && rank < s.rank {
+					s.found, s.u, s.rank, s.p, s.r, s.b = true, u, rank, p, r, b.ID
+				}
+				if s.candidates != nil {
+					s.candidates.add(Candidate{Topic: p.Topic, Partition: p.Partition, From: r, To: b.ID, Unbalance: u})
+				}
+			}
+
+			bl[ridx].Load = rload
+		}
+
+		for idx := range bl {
+			allowed[idx], replica[idx] = false, false
+		}
+	}
+}
+
+// MoveNonLeaders moves non-leader replicas from overloaded brokers to
+// underloaded brokers
+func MoveNonLeaders(pl *model.PartitionList, cfg RebalanceConfig) (*model.PartitionList, error) {
+	return move(pl, cfg, false)
+}
+
+// MoveLeaders moves leader replicas from overloaded brokers to underloaded
+// brokers
+func MoveLeaders(pl *model.PartitionList, cfg RebalanceConfig) (*model.PartitionList, error) {
+	if !cfg.AllowLeaderRebalancing {
+		return nil, nil
+	}
+
+	return move(pl, cfg, true)
+}
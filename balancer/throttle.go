@@ -0,0 +1,118 @@
+package balancer
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// ThrottledReplica identifies a replica of a partition of a topic, in the
+// form used by the leader.replication.throttled.replicas and
+// follower.replication.throttled.replicas topic configs
+type ThrottledReplica struct {
+	Partition model.PartitionID
+	Broker    model.BrokerID
+}
+
+func (r ThrottledReplica) String() string {
+	return fmt.Sprintf("%d:%d", r.Partition, r.Broker)
+}
+
+// ThrottleConfig contains the replication throttle settings needed to
+// execute a batch of reassignments
+type ThrottleConfig struct {
+	Rate      int64 // bytes/s, applied to all brokers in Brokers
+	Brokers   []model.BrokerID
+	Leaders   map[model.TopicName][]ThrottledReplica
+	Followers map[model.TopicName][]ThrottledReplica
+	BytesIn   map[model.BrokerID]int64
+	BytesOut  map[model.BrokerID]int64
+}
+
+// GetThrottleConfig computes the throttle settings for the batch of changes
+// in plan, applied to the partitions in orig. Like kafka-reassign-partitions.sh
+// it throttles all current replicas of a moving partition as leaders and all
+// new replicas as followers. The rate is the one needed for the busiest broker
+// to complete the batch in the specified duration; it is 0 if the partitions
+// have no size.
+func GetThrottleConfig(orig, plan *model.PartitionList, duration time.Duration) *ThrottleConfig {
+	tc := &ThrottleConfig{
+		Leaders:   make(map[model.TopicName][]ThrottledReplica),
+		Followers: make(map[model.TopicName][]ThrottledReplica),
+		BytesIn:   make(map[model.BrokerID]int64),
+		BytesOut:  make(map[model.BrokerID]int64),
+	}
+
+	current := make(map[partitionKey]model.Partition)
+	for _, p := range orig.Partitions {
+		current[keyOf(p)] = p
+	}
+
+	brokers := make(map[model.BrokerID]struct{})
+	added := make(map[partitionKey]map[model.BrokerID]struct{})
+	var order []partitionKey
+	for _, p := range plan.Partitions {
+		k := keyOf(p)
+		c, found := current[k]
+		if !found {
+			continue
+		}
+		if added[k] == nil {
+			added[k] = make(map[model.BrokerID]struct{})
+			order = append(order, k)
+		}
+		for _, r := range p.Replicas {
+			if !inBrokerList(c.Replicas, r) {
+				added[k][r] = struct{}{}
+			}
+		}
+	}
+
+	for _, k := range order {
+		c := current[k]
+		if len(added[k]) == 0 || len(c.Replicas) == 0 {
+			// replica removals and reorderings don't move any data
+			continue
+		}
+
+		for _, r := range c.Replicas {
+			tc.Leaders[k.Topic] = append(tc.Leaders[k.Topic], ThrottledReplica{k.Partition, r})
+			brokers[r] = struct{}{}
+		}
+
+		var followers []model.BrokerID
+		for r := range added[k] {
+			followers = append(followers, r)
+		}
+		sort.Sort(byBrokerID(followers))
+		for _, r := range followers {
+			tc.Followers[k.Topic] = append(tc.Followers[k.Topic], ThrottledReplica{k.Partition, r})
+			brokers[r] = struct{}{}
+			tc.BytesIn[r] += c.Size
+			tc.BytesOut[c.Replicas[0]] += c.Size
+		}
+	}
+
+	for id := range brokers {
+		tc.Brokers = append(tc.Brokers, id)
+	}
+	sort.Sort(byBrokerID(tc.Brokers))
+
+	var max int64
+	for _, id := range tc.Brokers {
+		if tc.BytesIn[id] > max {
+			max = tc.BytesIn[id]
+		}
+		if tc.BytesOut[id] > max {
+			max = tc.BytesOut[id]
+		}
+	}
+	if max > 0 && duration > 0 {
+		tc.Rate = int64(math.Ceil(float64(max) / duration.Seconds()))
+	}
+
+	return tc
+}
@@ -0,0 +1,40 @@
+package balancer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+func TestThrottleConfig(t *testing.T) {
+	orig := wrap([]model.Partition{
+		model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}, Size: 3600},
+		model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 3}, Size: 7200},
+		model.Partition{Topic: "b", Partition: 1, Replicas: []model.BrokerID{1, 2, 3}, Size: 100},
+	})
+	plan := wrap([]model.Partition{
+		model.Partition{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 4}},
+		model.Partition{Topic: "a", Partition: 2, Replicas: []model.BrokerID{2, 4}},
+		model.Partition{Topic: "b", Partition: 1, Replicas: []model.BrokerID{1, 2}},
+	})
+
+	tc := GetThrottleConfig(orig, plan, time.Hour)
+
+	if tc.Rate != 3 {
+		t.Errorf("expected rate 3, got %d", tc.Rate)
+	}
+	if !reflect.DeepEqual(tc.Brokers, []model.BrokerID{1, 2, 3, 4}) {
+		t.Errorf("unexpected brokers %v", tc.Brokers)
+	}
+	if !reflect.DeepEqual(tc.Leaders["a"], []ThrottledReplica{{1, 1}, {1, 2}, {2, 2}, {2, 3}}) {
+		t.Errorf("unexpected leader replicas %v", tc.Leaders)
+	}
+	if !reflect.DeepEqual(tc.Followers["a"], []ThrottledReplica{{1, 4}, {2, 4}}) {
+		t.Errorf("unexpected follower replicas %v", tc.Followers)
+	}
+	if _, found := tc.Leaders["b"]; found {
+		t.Errorf("unexpected throttle for replica removal %v", tc.Leaders["b"])
+	}
+}
@@ -0,0 +1,252 @@
+package balancer
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+type byBrokerID []model.BrokerID
+
+func (a byBrokerID) Len() int           { return len(a) }
+func (a byBrokerID) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byBrokerID) Less(i, j int) bool { return a[i] < a[j] }
+
+type brokerLoad struct {
+	ID   model.BrokerID
+	Load float64
+}
+
+type byBrokerLoad []brokerLoad
+
+func (a byBrokerLoad) Len() int      { return len(a) }
+func (a byBrokerLoad) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byBrokerLoad) Less(i, j int) bool {
+	if a[i].Load != a[j].Load {
+		return a[i].Load < a[j].Load
+	}
+	return a[i].ID < a[j].ID
+}
+
+func toBrokerSet(brokers []model.BrokerID) map[model.BrokerID]struct{} {
+	b := make(map[model.BrokerID]struct{})
+	for _, id := range brokers {
+		b[id] = struct{}{}
+	}
+
+	return b
+}
+
+func inBrokerList(haystack []model.BrokerID, needle model.BrokerID) bool {
+	for _, b := range haystack {
+		if b == needle {
+			return true
+		}
+	}
+
+	return false
+}
+
+func getBrokerList(pl *model.PartitionList) []model.BrokerID {
+	b := make(map[model.BrokerID]struct{})
+	for _, p := range pl.Partitions {
+		for _, r := range p.Replicas {
+			b[r] = struct{}{}
+		}
+	}
+
+	var brokers []model.BrokerID
+	for id := range b {
+		brokers = append(brokers, id)
+	}
+	sort.Sort(byBrokerID(brokers))
+
+	return brokers
+}
+
+// get the list of brokers in order from least loaded to most loaded
+func getBrokerListByLoad(loads map[model.BrokerID]float64, brokers []model.BrokerID) []model.BrokerID {
+	b := make([]brokerLoad, 0, len(brokers))
+	for _, id := range brokers {
+		b = append(b, brokerLoad{ID: id, Load: loads[id]})
+	}
+	sort.Sort(byBrokerLoad(b))
+
+	r := make([]model.BrokerID, 0, len(brokers))
+	for _, broker := range b {
+		r = append(r, broker.ID)
+	}
+	// add the allowed brokers we don't have the load of
+	for _, ID := range brokers {
+		if !inBrokerList(r, ID) {
+			r = append([]model.BrokerID{ID}, r...)
+		}
+	}
+
+	return r
+}
+
+// get the list of brokers in order from least loaded to most loaded
+func getBrokerListByLoadBL(loads []brokerLoad, brokers []model.BrokerID) []model.BrokerID {
+	r := make([]model.BrokerID, 0, len(brokers))
+	for _, load := range loads {
+		if inBrokerList(brokers, load.ID) {
+			r = append(r, load.ID)
+		}
+	}
+	// add the allowed brokers we don't have the load of
+	for _, ID := range brokers {
+		if !inBrokerList(r, ID) {
+			r = append([]model.BrokerID{ID}, r...)
+		}
+	}
+
+	return r
+}
+
+// count the replicas of the partition, other than the one on broker except,
+// that are in the same rack as broker b
+func rackConflicts(p model.Partition, racks map[model.BrokerID]string, except model.BrokerID, b model.BrokerID) int {
+	rack, found := racks[b]
+	if !found {
+		return 0
+	}
+
+	n := 0
+	for _, r := range p.Replicas {
+		if r != except && r != b && racks[r] == rack {
+			n++
+		}
+	}
+
+	return n
+}
+
+func getBrokerLoad(pl *model.PartitionList, lm LoadModel) map[model.BrokerID]float64 {
+	b := make(map[model.BrokerID]float64)
+	for _, p := range pl.Partitions {
+		for idx, r := range p.Replicas {
+			b[r] += lm.replicaLoad(p, idx)
+		}
+	}
+
+	return b
+}
+
+func getBL(loads map[model.BrokerID]float64) []brokerLoad {
+	// if we don't iterate in a constant order, float arithmetic causes the
+	// results to change in the LSBs
+	brokers := make([]brokerLoad, 0, len(loads))
+	for id, load := range loads {
+		brokers = append(brokers, brokerLoad{ID: id, Load: load})
+	}
+	sort.Sort(byBrokerLoad(brokers))
+
+	return brokers
+}
+
+func getUnbalanceBL(brokers []brokerLoad) float64 {
+	var sumBrokerLoad float64
+
+	for _, broker := range brokers {
+		sumBrokerLoad += broker.Load
+	}
+
+	avgBrokerLoad := sumBrokerLoad / float64(len(brokers))
+
+	var brokerUnbalance float64
+	for _, broker := range brokers {
+		relBrokerLoad := broker.Load/avgBrokerLoad - 1.0
+		brokerUnbalance += relBrokerLoad * relBrokerLoad
+	}
+
+	return brokerUnbalance
+}
+
+// unbalanceIndex estimates in O(1) the unbalance (see getUnbalanceBL) after
+// moving load from a broker to another. As the sum S of the loads of the n
+// brokers doesn't change, the unbalance is n²/S² × ΣL² - n, where only the
+// terms of ΣL² of the two brokers change.
+type unbalanceIndex struct {
+	idx   map[model.BrokerID]int // position of the brokers in bl
+	n     float64
+	sum   float64
+	sumSq float64
+}
+
+func newUnbalanceIndex(bl []brokerLoad) *unbalanceIndex {
+	ui := &unbalanceIndex{idx: make(map[model.BrokerID]int, len(bl)), n: float64(len(bl))}
+	for idx, b := range bl {
+		ui.idx[b.ID] = idx
+		ui.sum += b.Load
+		ui.sumSq += b.Load * b.Load
+	}
+
+	return ui
+}
+
+// estimate returns the unbalance after moving load w from a broker with load
+// from to a broker with load to
+func (ui *unbalanceIndex) estimate(from, to, w float64) float64 {
+	sumSq := ui.sumSq + 2*w*(to-from+w)
+	return ui.n*ui.n*sumSq/(ui.sum*ui.sum) - ui.n
+}
+
+// tolerance returns the maximum difference between an estimate and the
+// unbalance u computed by getUnbalanceBL: it is many orders of magnitude
+// larger than the rounding errors of both computations
+func (ui *unbalanceIndex) tolerance(u float64) float64 {
+	return 1e-9 * (ui.n + u)
+}
+
+type partitionKey struct {
+	Topic     model.TopicName
+	Partition model.PartitionID
+}
+
+func keyOf(p model.Partition) partitionKey {
+	return partitionKey{p.Topic, p.Partition}
+}
+
+func emptypl() *model.PartitionList {
+	return &model.PartitionList{Version: 1}
+}
+
+func singlepl(p model.Partition) *model.PartitionList {
+	return &model.PartitionList{Version: 1, Partitions: []model.Partition{p}}
+}
+
+// replacepl returns the partition with the replica on broker orig replaced by
+// one on broker repl (or removed, if repl is -1). The replicas of p are not
+// modified.
+func replacepl(p model.Partition, orig model.BrokerID, repl model.BrokerID) *model.PartitionList {
+	for idx, id := range p.Replicas {
+		if id == orig {
+			replicas := make([]model.BrokerID, 0, len(p.Replicas))
+			replicas = append(replicas, p.Replicas[:idx]...)
+			if repl != -1 {
+				replicas = append(replicas, repl)
+			}
+			p.Replicas = append(replicas, p.Replicas[idx+1:]...)
+			return singlepl(p)
+		}
+	}
+	panic(fmt.Sprintf("partition %v replicas don't contain %d", p, orig))
+}
+
+func leaderpl(p model.Partition, leader model.BrokerID) *model.PartitionList {
+	replicas := []model.BrokerID{leader}
+	for _, id := range p.Replicas {
+		if id != leader {
+			replicas = append(replicas, id)
+		}
+	}
+	p.Replicas = replicas
+	return singlepl(p)
+}
+
+func addpl(p model.Partition, b model.BrokerID) *model.PartitionList {
+	p.Replicas = append(append(make([]model.BrokerID, 0, len(p.Replicas)+1), p.Replicas...), b)
+	return singlepl(p)
+}
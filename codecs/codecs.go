@@ -0,0 +1,486 @@
+// Package codecs reads and writes the partition lists, policies, scenarios,
+// throttle scripts and reports used by the balancer.
+package codecs
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cafxx/kafkabalancer/balancer"
+	"github.com/cafxx/kafkabalancer/model"
+	kazoo "github.com/wvanbergen/kazoo-go"
+)
+
+// GetPartitionListFromReader parses a partition list, either in the JSON
+// format used by kafka-reassign-partitions.sh (extended with the fields of
+// model.Partition) or in the format of the output of kafka-topics.sh --describe
+func GetPartitionListFromReader(in io.Reader, isJSON bool) (*model.PartitionList, error) {
+	pl := &model.PartitionList{}
+
+	if isJSON {
+		dec := json.NewDecoder(in)
+		err := dec.Decode(pl)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing json: %s", err)
+		}
+		if pl.Version != 1 {
+			return nil, fmt.Errorf("wrong partition list version: expected 1, got %d", pl.Version)
+		}
+	} else {
+		scanner := bufio.NewScanner(in)
+		re := regexp.MustCompile("^\tTopic: ([^\t]*)\tPartition: ([0-9]*)\tLeader: ([0-9]*)\tReplicas: ([0-9,]*)\tIsr: ([0-9,]*)")
+		for scanner.Scan() {
+			m := re.FindStringSubmatch(scanner.Text())
+			if m == nil {
+				continue
+			}
+			partition, _ := strconv.Atoi(m[2])
+			strreplicas := strings.Split(m[4], ",")
+			var replicas []model.BrokerID
+			for _, strreplica := range strreplicas {
+				replica, _ := strconv.Atoi(strreplica)
+				replicas = append(replicas, model.BrokerID(replica))
+			}
+			pl.Partitions = append(pl.Partitions, model.Partition{
+				Topic:     model.TopicName(m[1]),
+				Partition: model.PartitionID(partition),
+				Replicas:  replicas,
+			})
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed reading file: %s", err)
+		}
+	}
+
+	if len(pl.Partitions) == 0 {
+		return nil, fmt.Errorf("empty partition list")
+	}
+
+	return pl, nil
+}
+
+// WritePartitionList writes the partition list in the JSON format used by
+// kafka-reassign-partitions.sh
+func WritePartitionList(out io.Writer, pl *model.PartitionList) error {
+	enc := json.NewEncoder(out)
+	pl.Version = 1
+	err := enc.Encode(pl)
+	if err != nil {
+		return fmt.Errorf("failed serializing json: %s", err)
+	}
+
+	return nil
+}
+
+// PlanMetadata describes how a plan was generated, so that it can be
+// reproduced from the same input
+type PlanMetadata struct {
+	// Version is the version of kafkabalancer
+	Version string `json:"version"`
+	// Config is the configuration used, in the format of the configuration
+	// files
+	Config interface{} `json:"config"`
+	// InputHash is the hash of the partition list read as input, before
+	// applying the replication policy (see HashPartitionList)
+	InputHash string `json:"input_hash"`
+}
+
+// WritePlan writes the partition list like WritePartitionList, adding the
+// metadata describing how it was generated in the "metadata" field, that
+// kafka-reassign-partitions.sh ignores
+func WritePlan(out io.Writer, pl *model.PartitionList, meta *PlanMetadata) error {
+	enc := json.NewEncoder(out)
+	pl.Version = 1
+	err := enc.Encode(struct {
+		*model.PartitionList
+		Metadata *PlanMetadata `json:"metadata"`
+	}{pl, meta})
+	if err != nil {
+		return fmt.Errorf("failed serializing json: %s", err)
+	}
+
+	return nil
+}
+
+// HashPartitionList returns the hex encoded SHA-256 hash of the JSON encoding
+// of the partition list, sorted by topic and partition: it doesn't depend on
+// the order of the partitions
+func HashPartitionList(pl *model.PartitionList) (string, error) {
+	spl := pl.Copy()
+	spl.Sort()
+	h := sha256.New()
+	if err := json.NewEncoder(h).Encode(spl); err != nil {
+		return "", fmt.Errorf("failed serializing json: %s", err)
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// GetPartitionListFromZookeeper reads the partition list of the kafka cluster
+// using the specified zookeeper connection string
+func GetPartitionListFromZookeeper(zkConnStr string) (*model.PartitionList, error) {
+	zk, err := kazoo.NewKazooFromConnectionString(zkConnStr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing zk connection string: %v", err)
+	}
+	defer zk.Close()
+
+	pl := &model.PartitionList{}
+
+	topics, err := zk.Topics()
+	if err != nil {
+		return nil, fmt.Errorf("failed reading topic list from zk: %v", err)
+	}
+
+	for _, topic := range topics {
+		partitions, err := topic.Partitions()
+		if err != nil {
+			return nil, fmt.Errorf("failed reading partition list for topic %s from zk: %v", topic.Name, err)
+		}
+
+		for _, partition := range partitions {
+			replicas := make([]model.BrokerID, 0, len(partition.Replicas))
+			for _, replica := range partition.Replicas {
+				replicas = append(replicas, model.BrokerID(replica))
+			}
+			pl.Partitions = append(pl.Partitions, model.Partition{
+				Topic:     model.TopicName(topic.Name),
+				Partition: model.PartitionID(partition.ID),
+				Replicas:  replicas,
+				// NumConsumers: <number of consumer groups>,
+				// Weight: <number of messages> or <size of messages>,
+			})
+		}
+	}
+
+	return pl, nil
+}
+
+// GetPolicyFromReader parses a JSON policy
+func GetPolicyFromReader(in io.Reader) (*balancer.Policy, error) {
+	policy := &balancer.Policy{}
+
+	dec := json.NewDecoder(in)
+	err := dec.Decode(policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing json: %s", err)
+	}
+	if policy.Version != 1 {
+		return nil, fmt.Errorf("wrong policy version: expected 1, got %d", policy.Version)
+	}
+
+	return policy, nil
+}
+
+// GetAffinitiesFromReader parses a JSON list of affinity rules
+func GetAffinitiesFromReader(in io.Reader) ([]balancer.AffinityRule, error) {
+	affinities := struct {
+		Version int                     `json:"version"`
+		Rules   []balancer.AffinityRule `json:"rules"`
+	}{}
+
+	dec := json.NewDecoder(in)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&affinities)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing json: %s", err)
+	}
+	if affinities.Version != 1 {
+		return nil, fmt.Errorf("wrong affinity rules version: expected 1, got %d", affinities.Version)
+	}
+
+	return affinities.Rules, nil
+}
+
+func throttledTopics(tc *balancer.ThrottleConfig) []model.TopicName {
+	var topics []model.TopicName
+	for t := range tc.Leaders {
+		topics = append(topics, t)
+	}
+	sort.Slice(topics, func(i, j int) bool { return topics[i] < topics[j] })
+	return topics
+}
+
+func joinReplicas(replicas []balancer.ThrottledReplica) string {
+	s := make([]string, 0, len(replicas))
+	for _, r := range replicas {
+		s = append(s, r.String())
+	}
+	return strings.Join(s, ",")
+}
+
+// WriteThrottleScript writes a shell script that, using kafka-configs.sh,
+// sets (when invoked with "set") or clears (when invoked with "clear") the
+// throttle settings in tc. zkConnStr is used as the default value for the ZK
+// environment variable.
+func WriteThrottleScript(out io.Writer, tc *balancer.ThrottleConfig, zkConnStr string) error {
+	const cmd = "kafka-configs.sh --zookeeper \"$ZK\" --alter --entity-type"
+	const rates = "leader.replication.throttled.rate,follower.replication.throttled.rate"
+	const replicas = "leader.replication.throttled.replicas,follower.replication.throttled.replicas"
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "#!/bin/sh\n")
+	fmt.Fprintf(&b, "# replication throttle for a batch of %d partitions, rate %d bytes/s\n", throttledPartitions(tc), tc.Rate)
+	fmt.Fprintf(&b, "# usage: $0 set|clear (run \"set\" before executing the reassignment and \"clear\" once it completed)\n")
+	fmt.Fprintf(&b, "ZK=\"${ZK:-%s}\"\n", zkConnStr)
+	fmt.Fprintf(&b, "set -e\n")
+	fmt.Fprintf(&b, "case \"$1\" in\n")
+	fmt.Fprintf(&b, "set)\n")
+	for _, id := range tc.Brokers {
+		fmt.Fprintf(&b, "  %s brokers --entity-name %d --add-config 'leader.replication.throttled.rate=%d,follower.replication.throttled.rate=%d'\n", cmd, id, tc.Rate, tc.Rate)
+	}
+	for _, t := range throttledTopics(tc) {
+		fmt.Fprintf(&b, "  %s topics --entity-name '%s' --add-config 'leader.replication.throttled.replicas=[%s],follower.replication.throttled.replicas=[%s]'\n", cmd, t, joinReplicas(tc.Leaders[t]), joinReplicas(tc.Followers[t]))
+	}
+	fmt.Fprintf(&b, "  ;;\n")
+	fmt.Fprintf(&b, "clear)\n")
+	for _, id := range tc.Brokers {
+		fmt.Fprintf(&b, "  %s brokers --entity-name %d --delete-config '%s'\n", cmd, id, rates)
+	}
+	for _, t := range throttledTopics(tc) {
+		fmt.Fprintf(&b, "  %s topics --entity-name '%s' --delete-config '%s'\n", cmd, t, replicas)
+	}
+	fmt.Fprintf(&b, "  ;;\n")
+	fmt.Fprintf(&b, "*)\n")
+	fmt.Fprintf(&b, "  echo \"usage: $0 set|clear\" >&2\n")
+	fmt.Fprintf(&b, "  exit 1\n")
+	fmt.Fprintf(&b, "esac\n")
+
+	_, err := io.WriteString(out, b.String())
+	if err != nil {
+		return fmt.Errorf("failed writing throttle script: %s", err)
+	}
+
+	return nil
+}
+
+func throttledPartitions(tc *balancer.ThrottleConfig) int {
+	n := 0
+	for _, replicas := range tc.Followers {
+		partitions := make(map[model.PartitionID]struct{})
+		for _, r := range replicas {
+			partitions[r.Partition] = struct{}{}
+		}
+		n += len(partitions)
+	}
+	return n
+}
+
+// WriteExplanations writes the explanations of the changes proposed by the
+// balancer, either as human-readable text or as JSON
+func WriteExplanations(out io.Writer, explanations []*balancer.Explanation, isJSON bool) error {
+	if isJSON {
+		if explanations == nil {
+			explanations = []*balancer.Explanation{}
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(explanations); err != nil {
+			return fmt.Errorf("failed serializing json: %s", err)
+		}
+		return nil
+	}
+
+	var b strings.Builder
+	for idx, e := range explanations {
+		fmt.Fprintf(&b, "change %d: proposed by %s\n", idx+1, e.Step)
+		for cidx, p := range e.Changes {
+			if cidx < len(e.Original) {
+				fmt.Fprintf(&b, "  %s/%d: replicas %v -> %v\n", p.Topic, p.Partition, e.Original[cidx].Replicas, p.Replicas)
+			} else {
+				fmt.Fprintf(&b, "  %s/%d: replicas %v\n", p.Topic, p.Partition, p.Replicas)
+			}
+		}
+		fmt.Fprintf(&b, "  unbalance: %g -> %g\n", e.UnbalanceBefore, e.UnbalanceAfter)
+		for _, bl := range e.Brokers {
+			fmt.Fprintf(&b, "  broker %d: load %g -> %g\n", bl.ID, bl.Before, bl.After)
+		}
+		if len(e.Candidates) > 0 {
+			fmt.Fprintf(&b, "  candidates:\n")
+		}
+		for _, c := range e.Candidates {
+			chosen := ""
+			if c.Chosen {
+				chosen = " (chosen)"
+			}
+			fmt.Fprintf(&b, "    %s/%d: move replica from broker %d to broker %d, unbalance %g%s\n", c.Topic, c.Partition, c.From, c.To, c.Unbalance, chosen)
+		}
+	}
+
+	if _, err := io.WriteString(out, b.String()); err != nil {
+		return fmt.Errorf("failed writing explanations: %s", err)
+	}
+
+	return nil
+}
+
+// GetScenarioFromReader parses a scenario in JSON format
+func GetScenarioFromReader(in io.Reader) (*balancer.Scenario, error) {
+	sc := &balancer.Scenario{}
+
+	// reject misspelled fields, that would silently change the scenario
+	dec := json.NewDecoder(in)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(sc)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing json: %s", err)
+	}
+	if sc.Version != 1 {
+		return nil, fmt.Errorf("wrong scenario version: expected 1, got %d", sc.Version)
+	}
+
+	return sc, nil
+}
+
+// WriteSimulation writes the outcome of a simulation, either as a
+// human-readable table or as JSON
+func WriteSimulation(out io.Writer, s *balancer.Simulation, isJSON bool) error {
+	if isJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(s); err != nil {
+			return fmt.Errorf("failed serializing json: %s", err)
+		}
+		return nil
+	}
+
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "BROKER\tLOAD BEFORE\tLOAD AFTER\n")
+	for _, br := range s.Brokers {
+		fmt.Fprintf(tw, "%d\t%g\t%g\n", br.ID, br.Before, br.After)
+	}
+	tw.Flush()
+
+	fmt.Fprintf(&b, "\nunbalance: %g -> %g\n", s.UnbalanceBefore, s.UnbalanceAfter)
+	if s.Converged {
+		fmt.Fprintf(&b, "moves: %d\n", s.Moves)
+	} else {
+		fmt.Fprintf(&b, "moves: more than %d\n", s.Moves)
+	}
+	fmt.Fprintf(&b, "replicas moved: %d (%d bytes)\n", s.ReplicasMoved, s.BytesMoved)
+	fmt.Fprintf(&b, "violations: %d\n", len(s.Violations))
+	for _, v := range s.Violations {
+		fmt.Fprintf(&b, "  %s/%d: %s\n", v.Topic, v.Partition, v.Problem)
+	}
+
+	if _, err := io.WriteString(out, b.String()); err != nil {
+		return fmt.Errorf("failed writing simulation: %s", err)
+	}
+
+	return nil
+}
+
+// WriteReport writes the report of the cluster, either as human-readable
+// tables or as JSON
+func WriteReport(out io.Writer, r *balancer.Report, isJSON bool) error {
+	if isJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			return fmt.Errorf("failed serializing json: %s", err)
+		}
+		return nil
+	}
+
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "BROKER\tLOAD\tREPLICAS\tLEADERS\tTOP TOPICS\n")
+	for _, br := range r.Brokers {
+		topics := make([]string, 0, len(br.Topics))
+		for _, t := range br.Topics {
+			topics = append(topics, fmt.Sprintf("%s (%g)", t.Topic, t.Load))
+		}
+		fmt.Fprintf(tw, "%d\t%g\t%d\t%d\t%s\n", br.ID, br.Load, br.Replicas, br.Leaders, strings.Join(topics, ", "))
+	}
+	tw.Flush()
+
+	fmt.Fprintf(&b, "\nunbalance: %g\n", r.Unbalance)
+	if r.Converged {
+		fmt.Fprintf(&b, "moves needed: %d\n", r.MovesNeeded)
+	} else {
+		fmt.Fprintf(&b, "moves needed: more than %d\n", r.MovesNeeded)
+	}
+	fmt.Fprintf(&b, "violations: %d\n", len(r.Violations))
+	for _, v := range r.Violations {
+		fmt.Fprintf(&b, "  %s/%d: %s\n", v.Topic, v.Partition, v.Problem)
+	}
+
+	if _, err := io.WriteString(out, b.String()); err != nil {
+		return fmt.Errorf("failed writing report: %s", err)
+	}
+
+	return nil
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WriteMetrics writes the report of the cluster in the Prometheus text
+// exposition format
+func WriteMetrics(out io.Writer, r *balancer.Report) error {
+	var b strings.Builder
+	metric := func(name, help string) {
+		fmt.Fprintf(&b, "# HELP kafkabalancer_%s %s\n# TYPE kafkabalancer_%s gauge\n", name, help, name)
+	}
+
+	metric("broker_load", "Load of the broker")
+	for _, br := range r.Brokers {
+		fmt.Fprintf(&b, "kafkabalancer_broker_load{broker=\"%d\"} %g\n", br.ID, br.Load)
+	}
+	metric("broker_replicas", "Number of replicas hosted by the broker")
+	for _, br := range r.Brokers {
+		fmt.Fprintf(&b, "kafkabalancer_broker_replicas{broker=\"%d\"} %d\n", br.ID, br.Replicas)
+	}
+	metric("broker_leaders", "Number of leader replicas hosted by the broker")
+	for _, br := range r.Brokers {
+		fmt.Fprintf(&b, "kafkabalancer_broker_leaders{broker=\"%d\"} %d\n", br.ID, br.Leaders)
+	}
+	metric("broker_topic_load", "Load caused on the broker by the topics contributing the most to its load")
+	for _, br := range r.Brokers {
+		for _, t := range br.Topics {
+			fmt.Fprintf(&b, "kafkabalancer_broker_topic_load{broker=\"%d\",topic=\"%s\"} %g\n", br.ID, labelEscaper.Replace(string(t.Topic)), t.Load)
+		}
+	}
+
+	violations := make(map[model.TopicName]int)
+	for _, v := range r.Violations {
+		violations[v.Topic]++
+	}
+	metric("topic_load", "Load caused by the topic on the cluster")
+	for _, t := range r.Topics {
+		fmt.Fprintf(&b, "kafkabalancer_topic_load{topic=\"%s\"} %g\n", labelEscaper.Replace(string(t.Topic)), t.Load)
+	}
+	metric("topic_violations", "Number of constraint violations of the partitions of the topic")
+	for _, t := range r.Topics {
+		fmt.Fprintf(&b, "kafkabalancer_topic_violations{topic=\"%s\"} %d\n", labelEscaper.Replace(string(t.Topic)), violations[t.Topic])
+	}
+
+	converged := 0
+	if r.Converged {
+		converged = 1
+	}
+	metric("unbalance", "Unbalance of the cluster")
+	fmt.Fprintf(&b, "kafkabalancer_unbalance %g\n", r.Unbalance)
+	metric("violations", "Number of constraint violations")
+	fmt.Fprintf(&b, "kafkabalancer_violations %d\n", len(r.Violations))
+	metric("moves_needed", "Number of reassignments needed to fix the violations and reach the minimum unbalance")
+	fmt.Fprintf(&b, "kafkabalancer_moves_needed %d\n", r.MovesNeeded)
+	metric("moves_needed_complete", "Whether moves_needed is exact (1) or a lower bound (0), as the balancer did not converge within the maximum number of reassignments or the time available")
+	fmt.Fprintf(&b, "kafkabalancer_moves_needed_complete %d\n", converged)
+
+	if _, err := io.WriteString(out, b.String()); err != nil {
+		return fmt.Errorf("failed writing metrics: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,335 @@
+package codecs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/cafxx/kafkabalancer/balancer"
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+func TestParsingJSON(t *testing.T) {
+	const jsonStr = `{"version":1,
+   "partitions":[{"topic":"foo1","partition":2,"replicas":[1,2]},
+                 {"topic":"foo1","partition":0,"replicas":[1,2]},
+                 {"topic":"foo2","partition":2,"replicas":[1,2]},
+                 {"topic":"foo2","partition":0,"replicas":[1,3]},
+                 {"topic":"foo1","partition":1,"replicas":[1,3]},
+                 {"topic":"foo2","partition":1,"replicas":[1,4]}]
+  }`
+
+	_, err := GetPartitionListFromReader(bytes.NewBufferString(jsonStr), true)
+
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestWritingJSON(t *testing.T) {
+	const jsonStr = `{"version":1,
+   "partitions":[{"topic":"foo1","partition":2,"replicas":[1,2]},
+                 {"topic":"foo1","partition":0,"replicas":[1,2]},
+                 {"topic":"foo2","partition":2,"replicas":[1,2]},
+                 {"topic":"foo2","partition":0,"replicas":[1,3]},
+                 {"topic":"foo1","partition":1,"replicas":[1,3]},
+                 {"topic":"foo2","partition":1,"replicas":[1,4]}]
+  }`
+
+	pl, err := GetPartitionListFromReader(bytes.NewBufferString(jsonStr), true)
+
+	if err != nil {
+		t.Skip()
+	}
+
+	WritePartitionList(ioutil.Discard, pl)
+}
+
+func TestWritingPlan(t *testing.T) {
+	pl := &model.PartitionList{Version: 1, Partitions: []model.Partition{
+		{Topic: "foo1", Partition: 1, Replicas: []model.BrokerID{1, 3}},
+		{Topic: "foo1", Partition: 0, Replicas: []model.BrokerID{1, 2}},
+	}}
+	h, err := HashPartitionList(pl)
+	if err != nil || len(h) != 64 {
+		t.Fatalf("unexpected hash %s, error %v", h, err)
+	}
+	rpl := &model.PartitionList{Version: 1, Partitions: []model.Partition{pl.Partitions[1], pl.Partitions[0]}}
+	if rh, _ := HashPartitionList(rpl); rh != h {
+		t.Errorf("hash depends on the order of the partitions: %s != %s", rh, h)
+	}
+	if pl.Partitions[0].Partition != 1 {
+		t.Errorf("partition list modified: %v", pl)
+	}
+
+	buf := &bytes.Buffer{}
+	err = WritePlan(buf, pl, &PlanMetadata{Version: "1.2.3", Config: map[string]interface{}{"version": 1}, InputHash: h})
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	expected := `{"version":1,"partitions":[{"topic":"foo1","partition":1,"replicas":[1,3]},{"topic":"foo1","partition":0,"replicas":[1,2]}],"metadata":{"version":"1.2.3","config":{"version":1},"input_hash":"` + h + `"}}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected plan %s, expected %s", buf.String(), expected)
+	}
+
+	if _, err = GetPartitionListFromReader(buf, true); err != nil {
+		t.Errorf("unexpected error parsing plan: %s", err)
+	}
+}
+
+func TestParsingText(t *testing.T) {
+	const textStr = `Topic:test	PartitionCount:9	ReplicationFactor:3	Configs:
+	Topic: test	Partition: 0	Leader: 2	Replicas: 2,0,1	Isr: 0,1,2
+	Topic: test	Partition: 1	Leader: 0	Replicas: 0,1,2	Isr: 0,1,2
+	Topic: test	Partition: 2	Leader: 1	Replicas: 1,2,0	Isr: 0,1,2
+	Topic: test	Partition: 3	Leader: 2	Replicas: 2,1,0	Isr: 0,1,2
+	Topic: test	Partition: 4	Leader: 0	Replicas: 0,2,1	Isr: 0,1,2
+	Topic: test	Partition: 5	Leader: 1	Replicas: 1,0,2	Isr: 0,1,2
+	Topic: test	Partition: 6	Leader: 2	Replicas: 2,0,1	Isr: 0,1,2
+	Topic: test	Partition: 7	Leader: 0	Replicas: 0,1,2	Isr: 0,1,2
+	Topic: test	Partition: 8	Leader: 1	Replicas: 1,2,0	Isr: 0,1,2`
+
+	_, err := GetPartitionListFromReader(bytes.NewBufferString(textStr), false)
+
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestParsingPolicy(t *testing.T) {
+	const policyStr = `{"version":1,
+   "rules":[{"topic":"prod.*","num_replicas":3},
+            {"topic":"tmp.*","num_replicas":2,"brokers":[4,5],"weight_multiplier":0.5}]
+  }`
+
+	policy, err := GetPolicyFromReader(bytes.NewBufferString(policyStr))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(policy.Rules) != 2 || policy.Rules[1].WeightMultiplier != 0.5 {
+		t.Errorf("unexpected policy %v", policy)
+	}
+
+	for _, policyStr := range []string{`{"version":2,"rules":[]}`, `::malformed::`} {
+		if _, err := GetPolicyFromReader(bytes.NewBufferString(policyStr)); err == nil {
+			t.Errorf("policy %s: expected error", policyStr)
+		}
+	}
+}
+
+func TestParsingAffinities(t *testing.T) {
+	const affinitiesStr = `{"version":1,
+   "rules":[{"topic":"a","with":"b","anti":true},
+            {"topic":"c*","with":"d*","penalty":0.5}]
+  }`
+
+	rules, err := GetAffinitiesFromReader(bytes.NewBufferString(affinitiesStr))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(rules) != 2 || !rules[0].Anti || rules[1].Anti || rules[1].Penalty != 0.5 {
+		t.Errorf("unexpected rules %v", rules)
+	}
+
+	for _, affinitiesStr := range []string{`{"version":2,"rules":[]}`, `{"version":1,"rules":[{"topic":"a","with":"b","antiaffinity":true}]}`, `::malformed::`} {
+		if _, err := GetAffinitiesFromReader(bytes.NewBufferString(affinitiesStr)); err == nil {
+			t.Errorf("affinity rules %s: expected error", affinitiesStr)
+		}
+	}
+}
+
+func TestWritingThrottleScript(t *testing.T) {
+	tc := &balancer.ThrottleConfig{
+		Rate:    3,
+		Brokers: []model.BrokerID{1, 2, 3, 4},
+		Leaders: map[model.TopicName][]balancer.ThrottledReplica{
+			"a": {{Partition: 1, Broker: 1}, {Partition: 1, Broker: 2}, {Partition: 2, Broker: 2}, {Partition: 2, Broker: 3}},
+		},
+		Followers: map[model.TopicName][]balancer.ThrottledReplica{
+			"a": {{Partition: 1, Broker: 4}, {Partition: 2, Broker: 4}},
+		},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteThrottleScript(buf, tc, "zk:2181"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	for _, s := range []string{
+		"ZK=\"${ZK:-zk:2181}\"",
+		"--entity-type brokers --entity-name 4 --add-config 'leader.replication.throttled.rate=3,follower.replication.throttled.rate=3'",
+		"--entity-type topics --entity-name 'a' --add-config 'leader.replication.throttled.replicas=[1:1,1:2,2:2,2:3],follower.replication.throttled.replicas=[1:4,2:4]'",
+		"--entity-type topics --entity-name 'a' --delete-config 'leader.replication.throttled.replicas,follower.replication.throttled.replicas'",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("missing expected string %q in %s", s, buf.String())
+		}
+	}
+}
+
+func TestWritingExplanations(t *testing.T) {
+	e := []*balancer.Explanation{{
+		Step:            "MoveNonLeaders",
+		Original:        []model.Partition{{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 2}}},
+		Changes:         []model.Partition{{Topic: "a", Partition: 1, Replicas: []model.BrokerID{1, 3}}},
+		UnbalanceBefore: 1,
+		UnbalanceAfter:  0.5,
+		Brokers:         []balancer.BrokerLoadChange{{ID: 2, Before: 2, After: 1}, {ID: 3, Before: 0, After: 1}},
+		Candidates: []balancer.Candidate{
+			{Topic: "a", Partition: 2, From: 2, To: 3, Unbalance: 0.5},
+			{Topic: "a", Partition: 1, From: 2, To: 3, Unbalance: 0.5, Chosen: true},
+		},
+	}}
+
+	buf := &bytes.Buffer{}
+	if err := WriteExplanations(buf, e, false); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	for _, s := range []string{
+		"change 1: proposed by MoveNonLeaders",
+		"a/1: replicas [1 2] -> [1 3]",
+		"unbalance: 1 -> 0.5",
+		"broker 3: load 0 -> 1",
+		"a/2: move replica from broker 2 to broker 3, unbalance 0.5\n",
+		"a/1: move replica from broker 2 to broker 3, unbalance 0.5 (chosen)",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("missing expected string %q in %s", s, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := WriteExplanations(buf, e, true); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if !strings.Contains(buf.String(), `"unbalance_after": 0.5`) {
+		t.Errorf("missing expected string in %s", buf.String())
+	}
+}
+
+func TestWritingReport(t *testing.T) {
+	r := &balancer.Report{
+		Brokers: []balancer.BrokerReport{
+			{ID: 1, Load: 6, Replicas: 3, Leaders: 3, Topics: []balancer.TopicLoad{{Topic: "a", Load: 4}, {Topic: "b", Load: 2}}},
+			{ID: 2, Load: 2, Replicas: 2, Leaders: 0, Topics: []balancer.TopicLoad{{Topic: "a", Load: 2}}},
+		},
+		Unbalance:   0.5,
+		Violations:  []balancer.Violation{{Topic: "b", Partition: 1, Problem: "replica on disallowed broker 4"}},
+		MovesNeeded: 3,
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteReport(buf, r, false); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	for _, s := range []string{
+		"BROKER  LOAD  REPLICAS  LEADERS  TOP TOPICS\n",
+		"1       6     3         3        a (4), b (2)\n",
+		"unbalance: 0.5\n",
+		"moves needed: more than 3\n",
+		"b/1: replica on disallowed broker 4\n",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("missing expected string %q in %s", s, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := WriteReport(buf, r, true); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if !strings.Contains(buf.String(), `"moves_needed": 3`) {
+		t.Errorf("missing expected string in %s", buf.String())
+	}
+}
+
+func TestWritingMetrics(t *testing.T) {
+	r := &balancer.Report{
+		Brokers: []balancer.BrokerReport{
+			{ID: 1, Load: 6, Replicas: 3, Leaders: 3, Topics: []balancer.TopicLoad{{Topic: "a", Load: 4}, {Topic: "b\"", Load: 2}}},
+		},
+		Topics:      []balancer.TopicLoad{{Topic: "a", Load: 4}, {Topic: "b\"", Load: 2}},
+		Unbalance:   0.5,
+		Violations:  []balancer.Violation{{Topic: "a", Partition: 1, Problem: "replica on disallowed broker 4"}},
+		MovesNeeded: 3,
+		Converged:   true,
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteMetrics(buf, r); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	for _, s := range []string{
+		"# TYPE kafkabalancer_broker_load gauge\nkafkabalancer_broker_load{broker=\"1\"} 6\n",
+		"kafkabalancer_broker_leaders{broker=\"1\"} 3\n",
+		"kafkabalancer_broker_topic_load{broker=\"1\",topic=\"b\\\"\"} 2\n",
+		"kafkabalancer_topic_violations{topic=\"a\"} 1\n",
+		"kafkabalancer_topic_violations{topic=\"b\\\"\"} 0\n",
+		"kafkabalancer_unbalance 0.5\n",
+		"kafkabalancer_moves_needed 3\n",
+		"kafkabalancer_moves_needed_complete 1\n",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("missing expected string %q in %s", s, buf.String())
+		}
+	}
+}
+
+func TestParsingScenario(t *testing.T) {
+	const scenarioStr = `{"version":1,
+   "add_brokers":[10,11,12],
+   "racks":{"10":"a"},
+   "topics":[{"topic":"X","num_replicas":4}],
+   "new_topics":[{"topic":"Y","partitions":8,"num_replicas":3}]
+  }`
+
+	sc, err := GetScenarioFromReader(bytes.NewBufferString(scenarioStr))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(sc.AddBrokers) != 3 || sc.Racks[10] != "a" || sc.Topics[0].NumReplicas != 4 || sc.NewTopics[0].Partitions != 8 {
+		t.Errorf("unexpected scenario %v", sc)
+	}
+
+	for _, scenarioStr := range []string{`{"version":2}`, `{"version":1,"add_broker":[1]}`, `::malformed::`} {
+		if _, err := GetScenarioFromReader(bytes.NewBufferString(scenarioStr)); err == nil {
+			t.Errorf("scenario %s: expected error", scenarioStr)
+		}
+	}
+}
+
+func TestWritingSimulation(t *testing.T) {
+	s := &balancer.Simulation{
+		Brokers:         []balancer.BrokerLoadChange{{ID: 1, Before: 6, After: 4}, {ID: 10, Before: 0, After: 2}},
+		UnbalanceBefore: 2,
+		UnbalanceAfter:  0,
+		Moves:           2,
+		ReplicasMoved:   2,
+		BytesMoved:      1024,
+		Converged:       true,
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteSimulation(buf, s, false); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	for _, s := range []string{
+		"BROKER  LOAD BEFORE  LOAD AFTER\n",
+		"10      0            2\n",
+		"unbalance: 2 -> 0\n",
+		"moves: 2\n",
+		"replicas moved: 2 (1024 bytes)\n",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("missing expected string %q in %s", s, buf.String())
+		}
+	}
+
+	buf.Reset()
+	if err := WriteSimulation(buf, s, true); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if !strings.Contains(buf.String(), `"bytes_moved": 1024`) {
+		t.Errorf("missing expected string in %s", buf.String())
+	}
+}
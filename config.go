@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configFile is a configuration file: the keys of the defaults and of each
+// profile are the names of the command line flags
+type configFile struct {
+	Version  int                                   `json:"version"`
+	Defaults map[string]json.RawMessage            `json:"defaults"`
+	Profiles map[string]map[string]json.RawMessage `json:"profiles"`
+}
+
+// flags that can't be set in the configuration file
+var configFileFlags = map[string]bool{"config": true, "profile": true, "print-config": true, "help": true}
+
+// getConfigFile parses a configuration file in JSON format
+func getConfigFile(in io.Reader) (*configFile, error) {
+	cf := &configFile{}
+
+	dec := json.NewDecoder(in)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cf); err != nil {
+		return nil, fmt.Errorf("failed parsing json: %s", err)
+	}
+	if cf.Version != 1 {
+		return nil, fmt.Errorf("wrong config version: expected 1, got %d", cf.Version)
+	}
+
+	return cf, nil
+}
+
+// apply sets the flags not specified on the command line to the values in the
+// specified profile (if not empty) or in the defaults of the configuration
+// file
+func (cf *configFile) apply(f *flag.FlagSet, profile string) error {
+	values := cf.Defaults
+	if profile != "" {
+		p, found := cf.Profiles[profile]
+		if !found {
+			return fmt.Errorf("unknown profile \"%s\"", profile)
+		}
+		values = make(map[string]json.RawMessage, len(cf.Defaults)+len(p))
+		for name, v := range cf.Defaults {
+			values[name] = v
+		}
+		for name, v := range p {
+			values[name] = v
+		}
+	}
+
+	set := make(map[string]bool)
+	f.Visit(func(fl *flag.Flag) { set[fl.Name] = true })
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if f.Lookup(name) == nil || configFileFlags[name] {
+			return fmt.Errorf("invalid option \"%s\"", name)
+		}
+		if set[name] {
+			continue
+		}
+		vs, err := configValues(values[name])
+		if err != nil {
+			return fmt.Errorf("invalid value of option \"%s\": %s", name, err)
+		}
+		if _, ok := f.Lookup(name).Value.(*stringList); !ok {
+			vs = []string{strings.Join(vs, ",")}
+		}
+		for _, v := range vs {
+			if err := f.Set(name, v); err != nil {
+				return fmt.Errorf("invalid value of option \"%s\": %s", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// configValues converts a JSON value to the values to set the flag to: a list
+// is converted to its elements, an object (e.g. {"1": "a"}) to a list of
+// key:value pairs sorted by key
+func configValues(v json.RawMessage) ([]string, error) {
+	var i interface{}
+	dec := json.NewDecoder(bytes.NewReader(v))
+	dec.UseNumber()
+	if err := dec.Decode(&i); err != nil {
+		return nil, err
+	}
+
+	switch i := i.(type) {
+	case []interface{}:
+		vs := make([]string, 0, len(i))
+		for _, e := range i {
+			s, err := configScalar(e)
+			if err != nil {
+				return nil, err
+			}
+			vs = append(vs, s)
+		}
+		return vs, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(i))
+		for k := range i {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		vs := make([]string, 0, len(i))
+		for _, k := range keys {
+			s, err := configScalar(i[k])
+			if err != nil {
+				return nil, err
+			}
+			vs = append(vs, k+":"+s)
+		}
+		return vs, nil
+	default:
+		s, err := configScalar(i)
+		if err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	}
+}
+
+func configScalar(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		return "", fmt.Errorf("unexpected value %v", v)
+	}
+}
+
+// getConfig returns the current values of the flags as a configuration file
+func getConfig(f *flag.FlagSet) map[string]interface{} {
+	defaults := make(map[string]interface{})
+	f.VisitAll(func(fl *flag.Flag) {
+		if configFileFlags[fl.Name] {
+			return
+		}
+		switch v := fl.Value.(flag.Getter).Get().(type) {
+		case time.Duration:
+			defaults[fl.Name] = v.String()
+		default:
+			defaults[fl.Name] = v
+		}
+	})
+
+	return map[string]interface{}{"version": 1, "defaults": defaults}
+}
+
+// writeConfig writes the current values of the flags as a configuration file
+func writeConfig(out io.Writer, f *flag.FlagSet) error {
+	buf, err := json.MarshalIndent(getConfig(f), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed serializing json: %s", err)
+	}
+	if _, err = out.Write(append(buf, '\n')); err != nil {
+		return fmt.Errorf("failed writing config: %s", err)
+	}
+
+	return nil
+}
+
+// loadConfigFile reads the configuration file and applies it to the flags,
+// also returning the exit status to use on failure
+func loadConfigFile(f *flag.FlagSet, name, profile string) (int, error) {
+	in, err := os.Open(name)
+	if err != nil {
+		return 1, fmt.Errorf("failed opening file %s: %s", name, err)
+	}
+	cf, err := getConfigFile(in)
+	in.Close()
+	if err != nil {
+		return 2, fmt.Errorf("failed getting config: %s", err)
+	}
+
+	if err = cf.apply(f, profile); err != nil {
+		return 3, fmt.Errorf("failed applying config: %s", err)
+	}
+
+	return 0, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestConfigFile(t *testing.T) {
+	f := flag.NewFlagSet("test", flag.ContinueOnError)
+	minReplicas := f.Int("min-replicas", 2, "")
+	maxReassign := f.Int("max-reassign", 1, "")
+	brokers := f.String("broker-ids", "auto", "")
+	racks := f.String("broker-racks", "", "")
+	var exclude stringList
+	f.Var(&exclude, "exclude", "")
+	f.Parse([]string{"-max-reassign=5"})
+
+	cf, err := getConfigFile(strings.NewReader(`{"version":1,
+	  "defaults":{"min-replicas":3,"exclude":["a","b"]},
+	  "profiles":{"p":{"min-replicas":4,"max-reassign":2,"broker-ids":[1,2],"broker-racks":{"2":"b","1":"a"}}}}`))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if err = cf.apply(f, "p"); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if *minReplicas != 4 || *maxReassign != 5 || *brokers != "1,2" || *racks != "1:a,2:b" || exclude.String() != "a,b" {
+		t.Errorf("unexpected values %d %d %s %s %v", *minReplicas, *maxReassign, *brokers, *racks, exclude)
+	}
+
+	for _, c := range []struct {
+		config  string
+		profile string
+	}{
+		{`{"version":1,"defaults":{"foo":1}}`, ""},
+		{`{"version":1,"defaults":{"config":"x"}}`, ""},
+		{`{"version":1,"defaults":{"min-replicas":"x"}}`, ""},
+		{`{"version":1,"defaults":{"min-replicas":null}}`, ""},
+		{`{"version":1}`, "p"},
+	} {
+		cf, err := getConfigFile(strings.NewReader(c.config))
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		f := flag.NewFlagSet("test", flag.ContinueOnError)
+		f.Int("min-replicas", 2, "")
+		if err = cf.apply(f, c.profile); err == nil {
+			t.Errorf("%s: expected error", c.config)
+		}
+	}
+
+	for _, config := range []string{`{"version":2}`, `{"version":1,"profile":{}}`, `::malformed::`} {
+		if _, err := getConfigFile(strings.NewReader(config)); err == nil {
+			t.Errorf("%s: expected error", config)
+		}
+	}
+}
+
+func TestMainConfig(t *testing.T) {
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "-config=test/config.json", "-profile=test", "-max-reassign=2"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d: %s", rv, err.String())
+	}
+	if !strings.Contains(err.String(), "MinReplicasForRebalancing:1 ") || !strings.Contains(err.String(), "Exclude:[__consumer_offsets]") {
+		t.Fatalf("missing expected string: %s", err.String())
+	}
+	if strings.Count(out.String(), `"topic"`) != 2 {
+		t.Fatalf("unexpected output: %s", out.String())
+	}
+
+	out.Reset()
+	rv = run(nil, out, err, []string{"kafkabalancer", "-config=test/config.json", "-profile=test", "-max-reassign=2", "-print-config"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+	var cf struct {
+		Defaults map[string]interface{}
+	}
+	if err := json.Unmarshal(out.Bytes(), &cf); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if cf.Defaults["max-reassign"] != 2.0 || cf.Defaults["broker-ids"] != "1,2,3,4,5" || cf.Defaults["broker-racks"] != "1:a,2:b" || cf.Defaults["input"] != "test/test.json" {
+		t.Fatalf("unexpected config: %s", out.String())
+	}
+
+	for args, erv := range map[string]int{
+		"-config=test/missing.json": 1,
+		"-config=test/test.json":    2,
+		"-profile=test":             3,
+	} {
+		rv = run(nil, out, err, []string{"kafkabalancer", args})
+		if rv != erv {
+			t.Errorf("%s: unexpected rv %d", args, rv)
+		}
+	}
+	rv = run(nil, out, err, []string{"kafkabalancer", "-config=test/config.json", "-profile=bad"})
+	if rv != 3 {
+		t.Errorf("unexpected rv %d", rv)
+	}
+}
@@ -1,37 +1,27 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/cafxx/kafkabalancer/balancer"
+	"github.com/cafxx/kafkabalancer/codecs"
 	"github.com/cafxx/kafkabalancer/logbuf"
+	"github.com/cafxx/kafkabalancer/model"
 	"github.com/pkg/profile"
 )
 
-type BrokerID int
-type PartitionID int
-type TopicName string
-
-type PartitionList struct {
-	Version    int         `json:"version"`
-	Partitions []Partition `json:"partitions"`
-}
-
-type Partition struct {
-	Topic     TopicName   `json:"topic"`
-	Partition PartitionID `json:"partition"`
-	Replicas  []BrokerID  `json:"replicas"`
-	// extensions
-	Weight       float64    `json:"weight,omitempty"`        // default: 1.0
-	NumReplicas  int        `json:"num_replicas,omitempty"`  // default: len(replicas)
-	Brokers      []BrokerID `json:"brokers,omitempty"`       // default: (auto)
-	NumConsumers int        `json:"num_consumers,omitempty"` // default: 1
-}
+// version is the version of kafkabalancer recorded in the plans, set at build
+// time with -ldflags "-X main.version=..."
+var version = "dev"
 
 func main() {
 	os.Exit(run(os.Stdin, os.Stdout, os.Stderr, os.Args))
@@ -42,18 +32,64 @@ func run(i io.Reader, o io.Writer, e io.Writer, args []string) int {
 	defer be.Close()
 	log.SetOutput(be)
 
+	// the subcommands accept the same flags as the default command
+	cmd := ""
+	if len(args) > 1 && (args[1] == "report" || args[1] == "serve" || args[1] == "simulate") {
+		cmd = args[1]
+		args = append([]string{args[0]}, args[2:]...)
+	}
+
 	f := flag.NewFlagSet("kafkabalancer", flag.ContinueOnError)
 	f.SetOutput(be)
 	jsonInput := f.Bool("input-json", false, "Parse the input as JSON")
 	input := f.String("input", "", "Name of the file to read (if no file is specified read from stdin, can not be used with -from-zk)")
 	fromZK := f.String("from-zk", "", "Zookeeper connection string (can not be used with -input)")
 	maxReassign := f.Int("max-reassign", 1, "Maximum number of reassignments to generate")
+	maxMovesFrom := f.Int("max-moves-from", 0, "Maximum number of replicas moved away from each broker by the generated reassignments (0: no limit)")
+	maxMovesTo := f.Int("max-moves-to", 0, "Maximum number of replicas moved to each broker by the generated reassignments (0: no limit)")
 	fullOutput := f.Bool("full-output", false, "Output the full partition list: by default only the changes are printed")
 	pprof := f.Bool("pprof", false, "Enable CPU profiling")
-	allowLeader := f.Bool("allow-leader", DefaultRebalanceConfig().AllowLeaderRebalancing, "Consider the partition leader eligible for rebalancing")
-	minReplicas := f.Int("min-replicas", DefaultRebalanceConfig().MinReplicasForRebalancing, "Minimum number of replicas for a partition to be eligible for rebalancing")
-	minUnbalance := f.Float64("min-unbalance", DefaultRebalanceConfig().MinUnbalance, "Minimum unbalance value required to perform rebalancing")
+	allowLeader := f.Bool("allow-leader", balancer.DefaultRebalanceConfig().AllowLeaderRebalancing, "Consider the partition leader eligible for rebalancing")
+	minReplicas := f.Int("min-replicas", balancer.DefaultRebalanceConfig().MinReplicasForRebalancing, "Minimum number of replicas for a partition to be eligible for rebalancing")
+	minUnbalance := f.Float64("min-unbalance", balancer.DefaultRebalanceConfig().MinUnbalance, "Minimum unbalance value required to perform rebalancing")
+	loadProduceIn := f.Float64("load-produce-in", balancer.DefaultLoadModel().ProduceIn, "Load of each replica per unit of data produced to its partition")
+	loadReplicationOut := f.Float64("load-replication-out", balancer.DefaultLoadModel().ReplicationOut, "Load of the leader per unit of data produced to its partition, for each follower")
+	loadConsumeOut := f.Float64("load-consume-out", balancer.DefaultLoadModel().ConsumeOut, "Load of the leader per unit of data consumed from its partition")
+	loadMeasured := f.Bool("load-measured", false, "Use the measured bytes_in and bytes_out of the partitions as the data produced and consumed, instead of their weight")
+	metric := f.String("metric", balancer.DefaultMetric, "Metric used to measure the unbalance, one of "+strings.Join(balancer.RegisteredMetrics(), ", "))
 	brokerIDs := f.String("broker-ids", "auto", "Comma-separated list of broker IDs")
+	decommissionIDs := f.String("decommission", "", "Comma-separated list of IDs of the brokers to drain of all their replicas")
+	scaleOutIDs := f.String("scale-out", "", "Comma-separated list of IDs of the brokers added to the cluster to fill up to the average broker load")
+	brokerRacks := f.String("broker-racks", "", "Comma-separated list of broker racks, in the form broker:rack (e.g. 1:a,2:a,3:b)")
+	stepNames := f.String("steps", "", "Comma-separated list of the steps to execute, in order (default: all built-in steps)")
+	disabledStepNames := f.String("disable-steps", "", "Comma-separated list of the steps not to execute")
+	policyFile := f.String("policy", "", "Name of the JSON file containing the replication policy to apply to the partitions")
+	affinityFile := f.String("affinity", "", "Name of the JSON file containing the affinity and anti-affinity rules between topics")
+	var include, exclude stringList
+	f.Var(&include, "include", "Pattern of the topics eligible for rebalancing (glob, or regular expression if prefixed with \"re:\"; can be specified multiple times; default: all topics)")
+	f.Var(&exclude, "exclude", "Pattern of the topics not eligible for rebalancing (glob, or regular expression if prefixed with \"re:\"; can be specified multiple times)")
+	var coPartitioned stringList
+	f.Var(&coPartitioned, "co-partitioned", "Comma-separated list of the patterns of a group of co-partitioned topics, whose partitions with the same number are kept on the same replicas (can be specified multiple times)")
+	coPartitionedLeaders := f.Bool("co-partitioned-leaders", false, "Only keep the same leader for the partitions with the same number of the co-partitioned topics")
+	seed := f.Int64("seed", 0, "Seed used to break the ties between equally good reassignments pseudo-randomly (0: prefer the first partition in topic and partition order)")
+	parallelism := f.Int("parallelism", 0, "Maximum number of goroutines evaluating the candidate reassignments (0: number of CPUs)")
+	timeout := f.Duration("timeout", 0, "Maximum time spent planning reassignments: when reached, the reassignments found so far are returned (0: no limit)")
+	throttleOutput := f.String("throttle-output", "", "Name of the file to write the replication throttle script for the generated reassignments to")
+	throttleDuration := f.Duration("throttle-duration", time.Hour, "Time the generated reassignments should take to complete, used to compute the replication throttle rate from the partition sizes")
+	throttleRate := f.Int64("throttle-rate", 0, "Replication throttle rate in bytes/s (if 0 it is computed from the partition sizes and -throttle-duration)")
+	explainFormat := f.String("explain", "", "Explain why each reassignment was chosen, as \"text\" or \"json\"")
+	explainOutput := f.String("explain-output", "", "Name of the file to write the explanations to (default: stderr)")
+	check := f.Bool("check", false, "Check the cluster without generating reassignments: exit with status 5 if partitions violate their constraints, 6 if the unbalance exceeds -max-unbalance")
+	maxUnbalance := f.Float64("max-unbalance", 0.1, "Maximum unbalance value tolerated by -check")
+	metricsFile := f.String("metrics-file", "", "Name of the file to write the metrics of the cluster to, in the Prometheus text format, without generating reassignments")
+	metricsListen := f.String("metrics-listen", "", "Address to serve the metrics of the cluster on (at /metrics), in the Prometheus text format, without generating reassignments (requires -input or -from-zk)")
+	listen := f.String("listen", ":8080", "Address the serve subcommand listens on")
+	requestTimeout := f.Duration("request-timeout", time.Minute, "Maximum time the serve subcommand spends on a request")
+	reportFormat := f.String("report-format", "text", "Format of the output of the report and simulate subcommands, \"text\", \"json\" or \"prometheus\" (report only)")
+	scenarioFile := f.String("scenario", "", "Name of the JSON file containing the scenario to simulate (required by the simulate subcommand, that plans at most as many reassignments as the replicas of the resulting cluster)")
+	configName := f.String("config", "", "Name of the JSON file containing the default values of the flags")
+	profileName := f.String("profile", "", "Name of the profile of the config file to use")
+	printConfig := f.Bool("print-config", false, "Print the effective configuration, merging the flags and the config file, and exit")
 	help := f.Bool("help", false, "Display usage")
 	f.Usage = func() {
 		fmt.Fprintf(be, "Usage of %s:\n", args[0])
@@ -70,16 +106,110 @@ func run(i io.Reader, o io.Writer, e io.Writer, args []string) int {
 		return 0
 	}
 
-	var brokers []BrokerID
+	if *profileName != "" && *configName == "" {
+		log.Print("-profile requires -config")
+		f.Usage()
+		return 3
+	}
+
+	if *configName != "" {
+		if rv, err := loadConfigFile(f, *configName, *profileName); err != nil {
+			log.Print(err)
+			return rv
+		}
+	}
+
+	if *printConfig {
+		be.Flush(true)
+		if err := writeConfig(o, f); err != nil {
+			log.Print(err)
+			return 4
+		}
+		return 0
+	}
+
+	var brokers []model.BrokerID
 	if *brokerIDs != "auto" {
-		for _, broker := range strings.Split(*brokerIDs, ",") {
-			b, cerr := strconv.Atoi(broker)
+		var cerr error
+		brokers, cerr = parseBrokerList(*brokerIDs)
+		if cerr != nil {
+			log.Print(cerr)
+			f.Usage()
+			return 3
+		}
+	}
+
+	var decommission []model.BrokerID
+	if *decommissionIDs != "" {
+		var cerr error
+		decommission, cerr = parseBrokerList(*decommissionIDs)
+		if cerr != nil {
+			log.Print(cerr)
+			f.Usage()
+			return 3
+		}
+	}
+
+	var scaleOut []model.BrokerID
+	if *scaleOutIDs != "" {
+		var cerr error
+		scaleOut, cerr = parseBrokerList(*scaleOutIDs)
+		if cerr != nil {
+			log.Print(cerr)
+			f.Usage()
+			return 3
+		}
+	}
+
+	var racks map[model.BrokerID]string
+	if *brokerRacks != "" {
+		racks = make(map[model.BrokerID]string)
+		for _, br := range strings.Split(*brokerRacks, ",") {
+			kv := strings.SplitN(br, ":", 2)
+			b, cerr := strconv.Atoi(kv[0])
+			if cerr != nil || len(kv) != 2 || kv[1] == "" {
+				log.Printf("failed parsing broker racks \"%s\": invalid broker rack \"%s\"", *brokerRacks, br)
+				f.Usage()
+				return 3
+			}
+			racks[model.BrokerID(b)] = kv[1]
+		}
+	}
+
+	for _, pattern := range append(include, exclude...) {
+		if _, cerr := balancer.CompileTopicPattern(pattern); cerr != nil {
+			log.Print(cerr)
+			f.Usage()
+			return 3
+		}
+	}
+
+	steps := balancer.DefaultSteps()
+	if *stepNames != "" {
+		steps = nil
+		for _, name := range strings.Split(*stepNames, ",") {
+			s, cerr := balancer.LookupStep(name)
 			if cerr != nil {
-				log.Printf("failed parsing broker list \"%s\": %s", *brokerIDs, cerr)
+				log.Printf("failed parsing step list \"%s\": %s", *stepNames, cerr)
 				f.Usage()
 				return 3
 			}
-			brokers = append(brokers, BrokerID(b))
+			steps = append(steps, s)
+		}
+	}
+	if *disabledStepNames != "" {
+		for _, name := range strings.Split(*disabledStepNames, ",") {
+			if _, cerr := balancer.LookupStep(name); cerr != nil {
+				log.Printf("failed parsing step list \"%s\": %s", *disabledStepNames, cerr)
+				f.Usage()
+				return 3
+			}
+			for idx := 0; idx < len(steps); idx++ {
+				if steps[idx].Name() == name {
+					steps = append(steps[:idx], steps[idx+1:]...)
+					idx--
+				}
+			}
 		}
 	}
 
@@ -89,68 +219,339 @@ func run(i io.Reader, o io.Writer, e io.Writer, args []string) int {
 		return 3
 	}
 
-	if *input != "" && *fromZK != "" {
-		log.Print("can't specify both -input and -from-zk")
+	if *maxMovesFrom < 0 || *maxMovesTo < 0 {
+		log.Printf("invalid maximum moves from \"%d\" or to \"%d\" each broker", *maxMovesFrom, *maxMovesTo)
 		f.Usage()
 		return 3
 	}
 
-	var err error
+	if _, err := balancer.LookupMetric(*metric); err != nil {
+		log.Print(err)
+		f.Usage()
+		return 3
+	}
 
-	in := i
-	if *input != "" {
-		in, err = os.Open(*input)
-		if err != nil {
-			log.Printf("failed opening file %s: %s", *input, err)
-			return 1
+	loadModel := balancer.LoadModel{
+		ProduceIn:      *loadProduceIn,
+		ReplicationOut: *loadReplicationOut,
+		ConsumeOut:     *loadConsumeOut,
+		Measured:       *loadMeasured,
+	}
+	if err := loadModel.Validate(); err != nil {
+		log.Print(err)
+		f.Usage()
+		return 3
+	}
+
+	var affinities []balancer.AffinityRule
+	if *affinityFile != "" {
+		var rv int
+		var cerr error
+		affinities, rv, cerr = getAffinities(*affinityFile)
+		if cerr != nil {
+			log.Print(cerr)
+			return rv
 		}
-		defer in.(io.Closer).Close()
 	}
 
-	out := o
+	var coPartitionGroups []balancer.CoPartitionGroup
+	for _, group := range coPartitioned {
+		g := balancer.CoPartitionGroup{LeaderOnly: *coPartitionedLeaders}
+		if group != "" {
+			g.Topics = strings.Split(group, ",")
+		}
+		if cerr := g.Validate(); cerr != nil {
+			log.Print(cerr)
+			f.Usage()
+			return 3
+		}
+		coPartitionGroups = append(coPartitionGroups, g)
+	}
 
-	var pl *PartitionList
-	if *fromZK != "" {
-		pl, err = GetPartitionListFromZookeeper(*fromZK)
-	} else {
-		pl, err = GetPartitionListFromReader(in, *jsonInput)
+	if *parallelism < 0 {
+		log.Printf("invalid parallelism \"%d\"", *parallelism)
+		f.Usage()
+		return 3
 	}
-	if err != nil {
-		log.Printf("failed getting partition list: %s", err)
-		return 2
+
+	if *throttleDuration <= 0 || *throttleRate < 0 {
+		log.Printf("invalid replication throttle duration \"%s\" or rate \"%d\"", *throttleDuration, *throttleRate)
+		f.Usage()
+		return 3
 	}
 
-	cfg := RebalanceConfig{
+	if *explainFormat != "" && *explainFormat != "text" && *explainFormat != "json" {
+		log.Printf("invalid explain format \"%s\"", *explainFormat)
+		f.Usage()
+		return 3
+	}
+
+	if *maxUnbalance < 0 {
+		log.Printf("invalid max unbalance \"%g\"", *maxUnbalance)
+		f.Usage()
+		return 3
+	}
+
+	if *reportFormat != "text" && *reportFormat != "json" && *reportFormat != "prometheus" {
+		log.Printf("invalid report format \"%s\"", *reportFormat)
+		f.Usage()
+		return 3
+	}
+
+	if cmd == "simulate" && (*scenarioFile == "" || *reportFormat == "prometheus") {
+		log.Print("the simulate subcommand requires -scenario and a text or json -report-format")
+		f.Usage()
+		return 3
+	}
+
+	if *input != "" && *fromZK != "" {
+		log.Print("can't specify both -input and -from-zk")
+		f.Usage()
+		return 3
+	}
+
+	if *timeout < 0 {
+		log.Printf("invalid timeout \"%s\"", *timeout)
+		f.Usage()
+		return 3
+	}
+
+	if *requestTimeout <= 0 {
+		log.Printf("invalid request timeout \"%s\"", *requestTimeout)
+		f.Usage()
+		return 3
+	}
+
+	if *metricsListen != "" && *input == "" && *fromZK == "" {
+		log.Print("-metrics-listen requires either -input or -from-zk")
+		f.Usage()
+		return 3
+	}
+
+	cfg := balancer.RebalanceConfig{
 		AllowLeaderRebalancing:    *allowLeader,
 		MinReplicasForRebalancing: *minReplicas,
 		MinUnbalance:              *minUnbalance,
 		Brokers:                   brokers,
+		Include:                   include,
+		Exclude:                   exclude,
+		Decommission:              decommission,
+		Racks:                     racks,
+		ScaleOut:                  scaleOut,
+		Parallelism:               *parallelism,
+		Seed:                      *seed,
+		Metric:                    *metric,
+		LoadModel:                 &loadModel,
+		Affinities:                affinities,
+		CoPartitioned:             coPartitionGroups,
+		MaxMovesFrom:              *maxMovesFrom,
+		MaxMovesTo:                *maxMovesTo,
+		Explain:                   *explainFormat != "",
 	}
 
 	log.Printf("rebalance config: %+v", cfg)
+	cfg.Logger = log.New(be, "", log.LstdFlags)
+
+	b := balancer.New(steps...)
+
+	if cmd == "serve" {
+		var load func() (*model.PartitionList, error)
+		if *input != "" || *fromZK != "" {
+			load = func() (*model.PartitionList, error) {
+				pl, _, _, err := getPartitionList(nil, *input, *fromZK, *jsonInput, *policyFile)
+				return pl, err
+			}
+		}
+		srv := &http.Server{
+			Addr:         *listen,
+			Handler:      newServer(load, b, cfg, *maxReassign, *requestTimeout),
+			ReadTimeout:  *requestTimeout,
+			WriteTimeout: 2 * *requestTimeout,
+		}
+		log.Printf("serving on %s", *listen)
+		err := srv.ListenAndServe()
+		log.Printf("failed serving: %s", err)
+		return 4
+	}
 
-	opl := emptypl()
+	out := o
+
+	pl, hash, rv, err := getPartitionList(i, *input, *fromZK, *jsonInput, *policyFile)
+	if err != nil {
+		log.Print(err)
+		return rv
+	}
 
-	for i := 0; i < *maxReassign; i++ {
-		ppl, err := Balance(pl, cfg)
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	if len(decommission) > 0 {
+		de := balancer.GetDecommissionEstimate(pl, decommission)
+		log.Printf("decommission of brokers %v: %d replicas (%d leaders) to move, %d bytes to move, %d batches of up to %d reassignments", decommission, de.Replicas, de.Leaders, de.Bytes, de.Batches(*maxReassign), *maxReassign)
+	}
+
+	if *check {
+		h, err := balancer.GetHealth(pl, cfg)
 		if err != nil {
-			log.Printf("failed optimizing distribution: %s", err)
+			log.Printf("failed checking cluster: %s", err)
 			return 3
 		}
+		be.Flush(true)
+		rv := 0
+		status := "OK"
+		if len(h.Violations) > 0 {
+			rv, status = 5, "CRITICAL"
+		} else if h.Unbalance > *maxUnbalance {
+			rv, status = 6, "WARNING"
+		}
+		_, err = fmt.Fprintf(out, "%s: %d constraint violations, unbalance %g (max %g)\n", status, len(h.Violations), h.Unbalance, *maxUnbalance)
+		if err != nil {
+			log.Printf("failed writing check summary: %s", err)
+			return 4
+		}
+		return rv
+	}
 
-		if len(ppl.Partitions) == 0 {
-			break
+	if cmd == "simulate" {
+		sf, err := os.Open(*scenarioFile)
+		if err != nil {
+			log.Printf("failed opening file %s: %s", *scenarioFile, err)
+			return 1
 		}
+		sc, err := codecs.GetScenarioFromReader(sf)
+		sf.Close()
+		if err != nil {
+			log.Printf("failed getting scenario: %s", err)
+			return 2
+		}
+		cfg.Logger = nil
+		var sim *balancer.Simulation
+		maxMoves, err := balancer.SimulateMaxMoves(pl, cfg, sc)
+		if err == nil {
+			sim, err = b.Simulate(ctx, pl, cfg, sc, maxMoves)
+		}
+		if err != nil {
+			log.Printf("failed simulating scenario: %s", err)
+			return 3
+		}
+		be.Flush(true)
+		err = codecs.WriteSimulation(out, sim, *reportFormat == "json")
+		if err != nil {
+			log.Print(err)
+			return 4
+		}
+		return 0
+	}
+
+	if *metricsListen != "" {
+		// don't log the changes planned to count the moves needed
+		cfg.Logger = nil
+		load := func() (*model.PartitionList, error) {
+			pl, _, _, err := getPartitionList(nil, *input, *fromZK, *jsonInput, *policyFile)
+			return pl, err
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metricsHandler(load, b, cfg))
+		log.Printf("serving metrics on %s", *metricsListen)
+		err = http.ListenAndServe(*metricsListen, mux)
+		log.Printf("failed serving metrics: %s", err)
+		return 4
+	}
 
-		opl.Partitions = append(opl.Partitions, ppl.Partitions...)
+	if cmd == "report" || *metricsFile != "" {
+		// don't log the changes planned to count the moves needed
+		cfg.Logger = nil
+		r, err := b.Report(ctx, pl, cfg, balancer.DefaultMaxMoves(pl))
+		if err != nil {
+			log.Printf("failed computing report: %s", err)
+			return 3
+		}
+		be.Flush(true)
+		switch {
+		case *metricsFile != "":
+			err = writeMetricsFile(*metricsFile, r)
+		case *reportFormat == "prometheus":
+			err = codecs.WriteMetrics(out, r)
+		default:
+			err = codecs.WriteReport(out, r, *reportFormat == "json")
+		}
+		if err != nil {
+			log.Print(err)
+			return 4
+		}
+		return 0
+	}
+
+	opl, state, explanations, err := plan(ctx, b, pl, cfg, *maxReassign)
+	if err != nil {
+		log.Print(err)
+		return 3
+	}
+	if ctx.Err() != nil {
+		log.Printf("timeout reached: returning the %d reassignments found so far", len(opl.Partitions))
+	}
+
+	for _, sp := range balancer.GetScaleOutProgress(state, cfg) {
+		if sp.Target > 0 {
+			log.Printf("scale-out: broker %d load %.2f of target %.2f (%.1f%%)", sp.ID, sp.Load, sp.Target, 100*sp.Load/sp.Target)
+		}
+	}
+
+	if *throttleOutput != "" {
+		tc := balancer.GetThrottleConfig(pl, opl, *throttleDuration)
+		if *throttleRate > 0 {
+			tc.Rate = *throttleRate
+		}
+		if tc.Rate == 0 && len(tc.Brokers) > 0 {
+			log.Print("unable to compute the replication throttle rate: partition sizes are unknown, specify -throttle-rate")
+			return 3
+		}
+		log.Printf("replication throttle: %d bytes/s on brokers %v", tc.Rate, tc.Brokers)
+
+		tf, err := os.Create(*throttleOutput)
+		if err != nil {
+			log.Printf("failed creating file %s: %s", *throttleOutput, err)
+			return 4
+		}
+		err = codecs.WriteThrottleScript(tf, tc, *fromZK)
+		if cerr := tf.Close(); err == nil && cerr != nil {
+			err = fmt.Errorf("failed closing file %s: %s", *throttleOutput, cerr)
+		}
+		if err != nil {
+			log.Print(err)
+			return 4
+		}
+	}
+
+	if cfg.Explain {
+		var eo io.Writer = be
+		if *explainOutput != "" {
+			ef, err := os.Create(*explainOutput)
+			if err != nil {
+				log.Printf("failed creating file %s: %s", *explainOutput, err)
+				return 4
+			}
+			defer ef.Close()
+			eo = ef
+		}
+		err = codecs.WriteExplanations(eo, explanations, *explainFormat == "json")
+		if err != nil {
+			log.Print(err)
+			return 4
+		}
 	}
 
 	be.Flush(true)
 
 	if *fullOutput {
-		opl = pl
+		opl = state
 	}
-	err = WritePartitionList(out, opl)
+	meta := &codecs.PlanMetadata{Version: version, Config: getConfig(f), InputHash: hash}
+	err = codecs.WritePlan(out, opl, meta)
 	if err != nil {
 		log.Printf("failed writing partition list: %s", err)
 		return 4
@@ -158,3 +559,135 @@ func run(i io.Reader, o io.Writer, e io.Writer, args []string) int {
 
 	return 0
 }
+
+// plan invokes the balancer up to maxReassign times, returning the proposed
+// changes, the state resulting from applying them and their explanations. If
+// the context is done, the changes proposed so far are returned.
+func plan(ctx context.Context, b *balancer.Balancer, pl *model.PartitionList, cfg balancer.RebalanceConfig, maxReassign int) (*model.PartitionList, *model.PartitionList, []*balancer.Explanation, error) {
+	state := balancer.NewState(pl)
+	opl := &model.PartitionList{Version: 1}
+	var explanations []*balancer.Explanation
+
+	for i := 0; i < maxReassign; i++ {
+		res, err := b.BalanceState(ctx, state, cfg)
+		if err != nil && ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed optimizing distribution: %s", err)
+		}
+
+		if len(res.Changes.Partitions) == 0 {
+			break
+		}
+
+		opl.Partitions = append(opl.Partitions, res.Changes.Partitions...)
+		if res.Explanation != nil {
+			explanations = append(explanations, res.Explanation)
+		}
+	}
+
+	return opl, state.PartitionList(), explanations, nil
+}
+
+// getPartitionList reads the partition list from zookeeper (if fromZK is not
+// empty), from the file named input (if not empty) or from i, sorts it and
+// applies the replication policy in the file named policyFile (if not
+// empty). It also returns the hash of the partition list read, before
+// applying the policy, and on failure the exit status to use.
+func getPartitionList(i io.Reader, input, fromZK string, jsonInput bool, policyFile string) (*model.PartitionList, string, int, error) {
+	var pl *model.PartitionList
+	var err error
+	if fromZK != "" {
+		pl, err = codecs.GetPartitionListFromZookeeper(fromZK)
+	} else {
+		in := i
+		if input != "" {
+			f, err := os.Open(input)
+			if err != nil {
+				return nil, "", 1, fmt.Errorf("failed opening file %s: %s", input, err)
+			}
+			defer f.Close()
+			in = f
+		}
+		pl, err = codecs.GetPartitionListFromReader(in, jsonInput)
+	}
+	if err != nil {
+		return nil, "", 2, fmt.Errorf("failed getting partition list: %s", err)
+	}
+	pl.Sort()
+	hash, err := codecs.HashPartitionList(pl)
+	if err != nil {
+		return nil, "", 2, err
+	}
+
+	if policyFile != "" {
+		pf, err := os.Open(policyFile)
+		if err != nil {
+			return nil, "", 1, fmt.Errorf("failed opening file %s: %s", policyFile, err)
+		}
+		policy, err := codecs.GetPolicyFromReader(pf)
+		pf.Close()
+		if err != nil {
+			return nil, "", 2, fmt.Errorf("failed getting policy: %s", err)
+		}
+		err = balancer.ApplyPolicy(pl, policy)
+		if err != nil {
+			return nil, "", 3, fmt.Errorf("failed applying policy: %s", err)
+		}
+	}
+
+	return pl, hash, 0, nil
+}
+
+// getAffinities reads and validates the affinity rules in the file named
+// name. On failure it also returns the exit status to use.
+func getAffinities(name string) ([]balancer.AffinityRule, int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 1, fmt.Errorf("failed opening file %s: %s", name, err)
+	}
+	defer f.Close()
+
+	rules, err := codecs.GetAffinitiesFromReader(f)
+	if err != nil {
+		return nil, 2, fmt.Errorf("failed getting affinity rules: %s", err)
+	}
+	for _, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return nil, 3, err
+		}
+	}
+
+	return rules, 0, nil
+}
+
+func parseBrokerList(s string) ([]model.BrokerID, error) {
+	var brokers []model.BrokerID
+	for _, broker := range strings.Split(s, ",") {
+		b, err := strconv.Atoi(broker)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing broker list \"%s\": %s", s, err)
+		}
+		brokers = append(brokers, model.BrokerID(b))
+	}
+
+	return brokers, nil
+}
+
+// stringList is a flag.Value accumulating the values of a flag that can be
+// specified multiple times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Get() interface{} {
+	return append([]string{}, *l...)
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
@@ -2,10 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/cafxx/kafkabalancer/balancer"
+	"github.com/cafxx/kafkabalancer/codecs"
+	"github.com/cafxx/kafkabalancer/model"
 )
 
 func TestMainHelp(t *testing.T) {
@@ -124,6 +134,31 @@ func TestMainFullOutput(t *testing.T) {
 	}
 }
 
+func TestMainThrottle(t *testing.T) {
+	f, _ := ioutil.TempFile("", "throttle")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-throttle-output=" + f.Name()})
+	if rv != 3 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+	if !strings.Contains(err.String(), "specify -throttle-rate") {
+		t.Fatalf("missing expected string: %s", err.String())
+	}
+
+	out, err = &bytes.Buffer{}, &bytes.Buffer{}
+	rv = run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-throttle-output=" + f.Name(), "-throttle-rate=1000"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+	script, _ := ioutil.ReadFile(f.Name())
+	if !strings.Contains(string(script), "leader.replication.throttled.rate=1000") {
+		t.Fatalf("missing expected string: %s", script)
+	}
+}
+
 type failwriter struct{}
 
 func (_ *failwriter) Write(_ []byte) (int, error) {
@@ -164,3 +199,520 @@ func TestBrokenData(t *testing.T) {
 		t.Fatalf("missing expected string: %s", err.String())
 	}
 }
+
+func TestMainPolicy(t *testing.T) {
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-policy=test/policy.json"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+	if !strings.Contains(err.String(), "AddMissingReplicas") {
+		t.Fatalf("missing expected string: %s", err.String())
+	}
+}
+
+func TestMainPolicyMissing(t *testing.T) {
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-policy=test/missing.json"})
+	if rv != 1 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+}
+
+func TestMainDecommission(t *testing.T) {
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-decommission=4", "-broker-racks=1:a,2:a,3:b,4:b"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+	if !strings.Contains(err.String(), "decommission of brokers [4]: 1 replicas (1 leaders) to move, 0 bytes to move, 2 batches") {
+		t.Fatalf("missing expected string: %s", err.String())
+	}
+	if !strings.Contains(err.String(), "MoveDisallowedLeaders") {
+		t.Fatalf("missing expected string: %s", err.String())
+	}
+}
+
+func TestMainBrokerRacksMalformed(t *testing.T) {
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-broker-racks=1:a,2"})
+	if rv != 3 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+	if !strings.Contains(err.String(), "failed parsing broker racks") {
+		t.Fatalf("missing expected string: %s", err.String())
+	}
+}
+
+func TestMainScaleOut(t *testing.T) {
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-scale-out=5", "-max-reassign=3"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+	if !strings.Contains(err.String(), "ScaleOut: ") {
+		t.Fatalf("missing expected string: %s", err.String())
+	}
+	if !strings.Contains(err.String(), "scale-out: broker 5 load") {
+		t.Fatalf("missing expected string: %s", err.String())
+	}
+}
+
+func TestMainExplain(t *testing.T) {
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-broker-ids=1,2,3,4,5", "-explain=json"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+	if !strings.Contains(err.String(), `"step": "MoveNonLeaders"`) {
+		t.Fatalf("missing expected string: %s", err.String())
+	}
+}
+
+func TestMainExplainMalformed(t *testing.T) {
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-explain=xml"})
+	if rv != 3 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+}
+
+func TestMainReport(t *testing.T) {
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "report", "-input-json", "-input=test/test.json", "-broker-ids=1,2,3,4,5"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+	for _, s := range []string{"5       0     0         0", "moves needed: 2\n"} {
+		if !strings.Contains(out.String(), s) {
+			t.Fatalf("missing expected string %q: %s", s, out.String())
+		}
+	}
+
+	out.Reset()
+	rv = run(nil, out, err, []string{"kafkabalancer", "report", "-input-json", "-input=test/test.json", "-report-format=json"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+	if !strings.Contains(out.String(), `"unbalance": `) {
+		t.Fatalf("missing expected string: %s", out.String())
+	}
+
+	// the moves of leaders never converge: planning stops after as many
+	// moves as the replicas of the cluster
+	out.Reset()
+	rv = run(nil, out, err, []string{"kafkabalancer", "report", "-input-json", "-input=test/test.json", "-allow-leader"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+	if !strings.Contains(out.String(), "moves needed: more than 16\n") {
+		t.Fatalf("missing expected string: %s", out.String())
+	}
+}
+
+func TestMainCheck(t *testing.T) {
+	for _, c := range []struct {
+		args []string
+		rv   int
+		out  string
+	}{
+		{[]string{"-max-unbalance=10"}, 0, "OK: 0 constraint violations"},
+		{[]string{"-broker-ids=1,2,3"}, 5, "CRITICAL: 1 constraint violations"},
+		{nil, 6, "WARNING: 0 constraint violations"},
+	} {
+		out, err := &bytes.Buffer{}, &bytes.Buffer{}
+		rv := run(nil, out, err, append([]string{"kafkabalancer", "-check", "-input-json", "-input=test/test.json"}, c.args...))
+		if rv != c.rv {
+			t.Errorf("%v: unexpected rv %d", c.args, rv)
+		}
+		if !strings.HasPrefix(out.String(), c.out) || strings.Count(out.String(), "\n") != 1 {
+			t.Errorf("%v: unexpected output %s", c.args, out.String())
+		}
+	}
+}
+
+func TestMainSimulate(t *testing.T) {
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "simulate", "-input-json", "-input=test/test.json", "-scenario=test/scenario.json"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d: %s", rv, err.String())
+	}
+	for _, s := range []string{"6       0            ", "violations: 0\n"} {
+		if !strings.Contains(out.String(), s) {
+			t.Fatalf("missing expected string %q: %s", s, out.String())
+		}
+	}
+
+	for args, erv := range map[string]int{"-scenario=": 3, "-scenario=test/missing.json": 1, "-scenario=test/test.json": 2} {
+		rv = run(nil, out, err, []string{"kafkabalancer", "simulate", "-input-json", "-input=test/test.json", args})
+		if rv != erv {
+			t.Errorf("%s: unexpected rv %d", args, rv)
+		}
+	}
+}
+
+func TestMainTimeout(t *testing.T) {
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-max-reassign=10", "-timeout=1ns"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+	if !strings.Contains(err.String(), "timeout reached: returning the 0 reassignments found so far") {
+		t.Fatalf("missing expected string: %s", err.String())
+	}
+
+	rv = run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-timeout=-1s"})
+	if rv != 3 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+
+	// the changes proposed when the timeout is reached are part of the plan
+	pl, _, _, perr := getPartitionList(nil, "test/test.json", "", true, "")
+	if perr != nil {
+		t.Fatalf("unexpected error %s", perr)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b := balancer.New(balancer.NewStep("Cancel", func(pl *model.PartitionList, _ balancer.RebalanceConfig) (*model.PartitionList, error) {
+		cancel()
+		p := pl.Partitions[0]
+		p.Replicas = []model.BrokerID{p.Replicas[1], p.Replicas[0]}
+		return &model.PartitionList{Version: 1, Partitions: []model.Partition{p}}, nil
+	}))
+	opl, _, _, perr := plan(ctx, b, pl, balancer.DefaultRebalanceConfig(), 10)
+	if perr != nil {
+		t.Fatalf("unexpected error %s", perr)
+	}
+	if len(opl.Partitions) != 1 {
+		t.Errorf("unexpected changes %v", opl)
+	}
+}
+
+func TestMainSteps(t *testing.T) {
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-disable-steps=MoveNonLeaders"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+	if !strings.Contains(err.String(), "no candidate changes") {
+		t.Fatalf("missing expected string: %s", err.String())
+	}
+
+	out, err = &bytes.Buffer{}, &bytes.Buffer{}
+	rv = run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-steps=FillDefaults,MoveLeaders,Unknown"})
+	if rv != 3 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+	if !strings.Contains(err.String(), "unknown step Unknown") {
+		t.Fatalf("missing expected string: %s", err.String())
+	}
+}
+
+func TestMainParallelism(t *testing.T) {
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-max-reassign=1000", "-allow-leader", "-parallelism=1"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d: %s", rv, err.String())
+	}
+
+	pout, perr := &bytes.Buffer{}, &bytes.Buffer{}
+	rv = run(nil, pout, perr, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-max-reassign=1000", "-allow-leader", "-parallelism=4"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d: %s", rv, perr.String())
+	}
+	if pl, ppl := getPlan(t, out).PartitionList, getPlan(t, pout).PartitionList; !reflect.DeepEqual(pl, ppl) {
+		t.Fatalf("unexpected output %v, expected %v", ppl, pl)
+	}
+}
+
+func TestMainParallelismMalformed(t *testing.T) {
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-parallelism=-1"})
+	if rv != 3 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+	if !strings.Contains(err.String(), "invalid parallelism") {
+		t.Fatalf("missing expected string: %s", err.String())
+	}
+}
+
+func TestMainMaxMoves(t *testing.T) {
+	f, e := os.Open("test/test.json")
+	if e != nil {
+		t.Fatalf("failed opening test/test.json: %s", e)
+	}
+	defer f.Close()
+	pl, e := codecs.GetPartitionListFromReader(f, true)
+	if e != nil {
+		t.Fatalf("failed parsing test/test.json: %s", e)
+	}
+	replicas := make(map[string][]model.BrokerID)
+	for _, p := range pl.Partitions {
+		replicas[fmt.Sprintf("%s/%d", p.Topic, p.Partition)] = p.Replicas
+	}
+
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-max-reassign=1000", "-allow-leader", "-max-moves-to=1"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d: %s", rv, err.String())
+	}
+	plan := getPlan(t, out)
+	if len(plan.Partitions) != 3 {
+		t.Fatalf("unexpected plan %v", plan.Partitions)
+	}
+	to := make(map[model.BrokerID]int)
+	for _, p := range plan.Partitions {
+		k := fmt.Sprintf("%s/%d", p.Topic, p.Partition)
+		for _, r := range p.Replicas {
+			if !inList(replicas[k], r) {
+				to[r]++
+			}
+		}
+		replicas[k] = p.Replicas
+	}
+	// once broker 4 reaches its cap the replicas are moved to brokers 2 and 3,
+	// rather than stopping
+	for b, n := range to {
+		if n > 1 {
+			t.Errorf("%d replicas moved to broker %d: %v", n, b, plan.Partitions)
+		}
+	}
+
+	out, err = &bytes.Buffer{}, &bytes.Buffer{}
+	rv = run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-max-moves-to=-1"})
+	if rv != 3 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+	if !strings.Contains(err.String(), "invalid maximum moves") {
+		t.Fatalf("missing expected string: %s", err.String())
+	}
+}
+
+func inList(l []model.BrokerID, b model.BrokerID) bool {
+	for _, id := range l {
+		if id == b {
+			return true
+		}
+	}
+	return false
+}
+
+type planOutput struct {
+	*model.PartitionList
+	Metadata *codecs.PlanMetadata `json:"metadata"`
+}
+
+func getPlan(t *testing.T, out *bytes.Buffer) *planOutput {
+	p := &planOutput{}
+	if err := json.Unmarshal(out.Bytes(), p); err != nil {
+		t.Fatalf("failed parsing plan %s: %s", out.String(), err)
+	}
+	return p
+}
+
+func TestMainPlanMetadata(t *testing.T) {
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-max-reassign=3", "-seed=42"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d: %s", rv, err.String())
+	}
+	p := getPlan(t, out)
+	if len(p.Partitions) == 0 || p.Metadata == nil || p.Metadata.Version != version || len(p.Metadata.InputHash) != 64 {
+		t.Fatalf("unexpected plan %s", out.String())
+	}
+	cfg := p.Metadata.Config.(map[string]interface{})
+	defaults := cfg["defaults"].(map[string]interface{})
+	if cfg["version"] != 1.0 || defaults["seed"] != 42.0 || defaults["max-reassign"] != 3.0 || defaults["input"] != "test/test.json" {
+		t.Fatalf("unexpected config %v", cfg)
+	}
+
+	// the hash is the one of the input, before applying the policy
+	f, _ := os.Open("test/test.json")
+	pl, _ := codecs.GetPartitionListFromReader(f, true)
+	f.Close()
+	h, _ := codecs.HashPartitionList(pl)
+	pout, perr := &bytes.Buffer{}, &bytes.Buffer{}
+	rv = run(nil, pout, perr, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-policy=test/policy.json"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d: %s", rv, perr.String())
+	}
+	if p.Metadata.InputHash != h || getPlan(t, pout).Metadata.InputHash != h {
+		t.Fatalf("unexpected input hash %s, expected %s", p.Metadata.InputHash, h)
+	}
+
+	// the plan can be reproduced from its config
+	dir, _ := ioutil.TempDir("", "kafkabalancer")
+	defer os.RemoveAll(dir)
+	buf, _ := json.Marshal(cfg)
+	ioutil.WriteFile(filepath.Join(dir, "config.json"), buf, 0644)
+	rout, rerr := &bytes.Buffer{}, &bytes.Buffer{}
+	rv = run(nil, rout, rerr, []string{"kafkabalancer", "-config=" + filepath.Join(dir, "config.json")})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d: %s", rv, rerr.String())
+	}
+	if rout.String() != out.String() {
+		t.Fatalf("unexpected output %s, expected %s", rout.String(), out.String())
+	}
+}
+
+func TestMainCanonicalOrder(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kafkabalancer")
+	defer os.RemoveAll(dir)
+	pl, _, _, e := getPartitionList(nil, "test/test.json", "", true, "")
+	if e != nil {
+		t.Fatalf("unexpected error %s", e)
+	}
+	for i, j := 0, len(pl.Partitions)-1; i < j; i, j = i+1, j-1 {
+		pl.Partitions[i], pl.Partitions[j] = pl.Partitions[j], pl.Partitions[i]
+	}
+	f, _ := os.Create(filepath.Join(dir, "reversed.json"))
+	codecs.WritePartitionList(f, pl)
+	f.Close()
+
+	for _, seed := range []string{"0", "1"} {
+		out, err := &bytes.Buffer{}, &bytes.Buffer{}
+		rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-max-reassign=10", "-seed=" + seed})
+		if rv != 0 {
+			t.Fatalf("unexpected rv %d: %s", rv, err.String())
+		}
+		rout, rerr := &bytes.Buffer{}, &bytes.Buffer{}
+		rv = run(nil, rout, rerr, []string{"kafkabalancer", "-input-json", "-input=" + filepath.Join(dir, "reversed.json"), "-max-reassign=10", "-seed=" + seed})
+		if rv != 0 {
+			t.Fatalf("unexpected rv %d: %s", rv, rerr.String())
+		}
+		p, rp := getPlan(t, out), getPlan(t, rout)
+		if !reflect.DeepEqual(p.PartitionList, rp.PartitionList) || p.Metadata.InputHash != rp.Metadata.InputHash {
+			t.Fatalf("seed %s: unexpected output %s, expected %s", seed, rout.String(), out.String())
+		}
+	}
+}
+
+func TestMainMetric(t *testing.T) {
+	// broker loads: 15, 3, 4, 2
+	expected := map[string]float64{"squares": 3.055555555555556, "max": 1.5, "spread": 13.0 / 6, "gini": 0.4166666666666667}
+	for metric, unbalance := range expected {
+		out, err := &bytes.Buffer{}, &bytes.Buffer{}
+		rv := run(nil, out, err, []string{"kafkabalancer", "report", "-input-json", "-input=test/test.json", "-report-format=json", "-metric=" + metric})
+		if rv != 0 {
+			t.Fatalf("%s: unexpected rv %d: %s", metric, rv, err.String())
+		}
+		r := &balancer.Report{}
+		if e := json.Unmarshal(out.Bytes(), r); e != nil {
+			t.Fatalf("%s: failed parsing report %s: %s", metric, out.String(), e)
+		}
+		if r.Unbalance != unbalance || !r.Converged || r.MovesNeeded == 0 {
+			t.Errorf("%s: unexpected report %s", metric, out.String())
+		}
+	}
+
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-metric=foo"})
+	if rv != 3 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+	if !strings.Contains(err.String(), "unknown metric foo") {
+		t.Fatalf("missing expected string: %s", err.String())
+	}
+}
+
+func TestMainLoadModel(t *testing.T) {
+	loads := func(args ...string) map[model.BrokerID]float64 {
+		out, err := &bytes.Buffer{}, &bytes.Buffer{}
+		rv := run(nil, out, err, append([]string{"kafkabalancer", "report", "-input-json", "-input=test/test.json", "-report-format=json"}, args...))
+		if rv != 0 {
+			t.Fatalf("%v: unexpected rv %d: %s", args, rv, err.String())
+		}
+		r := &balancer.Report{}
+		if e := json.Unmarshal(out.Bytes(), r); e != nil {
+			t.Fatalf("%v: failed parsing report %s: %s", args, out.String(), e)
+		}
+		l := make(map[model.BrokerID]float64)
+		for _, b := range r.Brokers {
+			l[b.ID] = b.Load
+		}
+		return l
+	}
+
+	if l, expected := loads(), map[model.BrokerID]float64{1: 15, 2: 3, 3: 4, 4: 2}; !reflect.DeepEqual(l, expected) {
+		t.Errorf("unexpected loads %v, expected %v", l, expected)
+	}
+	// the leaders are loaded as much as the followers
+	if l, expected := loads("-load-replication-out=0", "-load-consume-out=0"), map[model.BrokerID]float64{1: 8, 2: 3, 3: 4, 4: 1}; !reflect.DeepEqual(l, expected) {
+		t.Errorf("unexpected loads %v, expected %v", l, expected)
+	}
+
+	for _, args := range [][]string{{"-load-produce-in=-1"}, {"-load-consume-out=-0.5"}, {"-load-measured"}} {
+		out, err := &bytes.Buffer{}, &bytes.Buffer{}
+		rv := run(nil, out, err, append([]string{"kafkabalancer", "-input-json", "-input=test/test.json"}, args...))
+		if rv != 3 {
+			t.Errorf("%v: unexpected rv %d", args, rv)
+		}
+	}
+}
+
+func TestMainAffinity(t *testing.T) {
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "report", "-input-json", "-input=test/test.json", "-report-format=json", "-affinity=test/affinity.json"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d: %s", rv, err.String())
+	}
+	r := &balancer.Report{}
+	if e := json.Unmarshal(out.Bytes(), r); e != nil {
+		t.Fatalf("failed parsing report %s: %s", out.String(), e)
+	}
+	// all replicas but the one of foo2 on broker 4 are on brokers hosting both
+	// topics
+	if len(r.Violations) != 15 || !strings.Contains(r.Violations[0].Problem, "anti-affinity between foo1 and foo2") {
+		t.Errorf("unexpected violations %v", r.Violations)
+	}
+
+	out, err = &bytes.Buffer{}, &bytes.Buffer{}
+	rv = run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-affinity=test/affinity.json", "-max-reassign=100"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d: %s", rv, err.String())
+	}
+	if !strings.Contains(err.String(), "ValidateAffinities: 15 replicas violate hard affinity rules and 0 soft ones") {
+		t.Errorf("missing expected string: %s", err.String())
+	}
+
+	for arg, expected := range map[string]int{"-affinity=test/missing.json": 1, "-affinity=test/test.json": 2} {
+		out, err := &bytes.Buffer{}, &bytes.Buffer{}
+		if rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", arg}); rv != expected {
+			t.Errorf("%s: unexpected rv %d, expected %d", arg, rv, expected)
+		}
+	}
+}
+
+func TestMainCoPartitioned(t *testing.T) {
+	// partitions 0 and 1 of foo1 and foo2 have different replicas, and
+	// partitions 1 also different leaders
+	for arg, expected := range map[string]int{"-co-partitioned-leaders=false": 2, "-co-partitioned-leaders=true": 1} {
+		out, err := &bytes.Buffer{}, &bytes.Buffer{}
+		rv := run(nil, out, err, []string{"kafkabalancer", "report", "-input-json", "-input=test/test.json", "-report-format=json", "-co-partitioned=foo1,foo2", arg})
+		if rv != 0 {
+			t.Fatalf("%s: unexpected rv %d: %s", arg, rv, err.String())
+		}
+		r := &balancer.Report{}
+		if e := json.Unmarshal(out.Bytes(), r); e != nil {
+			t.Fatalf("failed parsing report %s: %s", out.String(), e)
+		}
+		if len(r.Violations) != expected || r.Violations[len(r.Violations)-1].Problem != "leader not aligned to the one of foo1 partition 1" {
+			t.Errorf("%s: unexpected violations %v", arg, r.Violations)
+		}
+	}
+
+	out, err := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-co-partitioned=foo*", "-max-reassign=100"})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d: %s", rv, err.String())
+	}
+	if !strings.Contains(err.String(), "AlignCoPartitioned: ") {
+		t.Errorf("missing expected string: %s", err.String())
+	}
+
+	for _, arg := range []string{"-co-partitioned=", "-co-partitioned=re:("} {
+		out, err := &bytes.Buffer{}, &bytes.Buffer{}
+		if rv := run(nil, out, err, []string{"kafkabalancer", "-input-json", "-input=test/test.json", arg}); rv != 3 {
+			t.Errorf("%s: unexpected rv %d, expected 3", arg, rv)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/cafxx/kafkabalancer/balancer"
+	"github.com/cafxx/kafkabalancer/codecs"
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// metricsHandler serves the metrics of the partition list returned by load,
+// that is invoked on each request so that the metrics reflect the current
+// state of the cluster. At most balancer.DefaultMaxMoves reassignments are
+// planned: if more are needed, or the request is canceled, moves_needed is a
+// lower bound and moves_needed_complete is 0.
+func metricsHandler(load func() (*model.PartitionList, error), b *balancer.Balancer, cfg balancer.RebalanceConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pl, err := load()
+		if err != nil {
+			log.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		rep, err := b.Report(r.Context(), pl, cfg, balancer.DefaultMaxMoves(pl))
+		if err != nil {
+			log.Printf("failed computing report: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		buf := &bytes.Buffer{}
+		if err = codecs.WriteMetrics(buf, rep); err != nil {
+			log.Print(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(buf.Bytes())
+	})
+}
+
+// writeMetricsFile atomically replaces the file named name with the metrics
+// of the report, as required by the node-exporter textfile collector
+func writeMetricsFile(name string, r *balancer.Report) error {
+	tmp := name + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed creating file %s: %s", tmp, err)
+	}
+	err = codecs.WriteMetrics(f, r)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("failed closing file %s: %s", tmp, cerr)
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cafxx/kafkabalancer/balancer"
+	"github.com/cafxx/kafkabalancer/codecs"
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	load := func() (*model.PartitionList, error) {
+		f, err := os.Open("test/test.json")
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return codecs.GetPartitionListFromReader(f, true)
+	}
+
+	s := httptest.NewServer(metricsHandler(load, balancer.New(balancer.DefaultSteps()...), balancer.DefaultRebalanceConfig()))
+	defer s.Close()
+
+	res, err := http.Get(s.URL)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("unexpected response %s: %s", res.Status, body)
+	}
+	if !strings.Contains(string(body), "kafkabalancer_broker_load{broker=\"1\"} 15\n") {
+		t.Fatalf("missing expected string: %s", body)
+	}
+
+	// the moves of leaders never converge: the scrape still completes
+	cfg := balancer.DefaultRebalanceConfig()
+	cfg.AllowLeaderRebalancing = true
+	rec := httptest.NewRecorder()
+	metricsHandler(load, balancer.New(balancer.DefaultSteps()...), cfg).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	for _, s := range []string{"kafkabalancer_moves_needed 16\n", "kafkabalancer_moves_needed_complete 0\n"} {
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), s) {
+			t.Fatalf("missing expected string %q: %s", s, rec.Body.String())
+		}
+	}
+}
+
+func TestMetricsHandlerError(t *testing.T) {
+	load := func() (*model.PartitionList, error) {
+		return nil, errors.New("zookeeper unreachable")
+	}
+
+	rec := httptest.NewRecorder()
+	h := metricsHandler(load, balancer.New(balancer.DefaultSteps()...), balancer.DefaultRebalanceConfig())
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+}
+
+func TestMainMetricsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kafkabalancer")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "kafkabalancer.prom")
+
+	out, e := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, e, []string{"kafkabalancer", "-input-json", "-input=test/test.json", "-allow-leader", "-metrics-file=" + name})
+	if rv != 0 {
+		t.Fatalf("unexpected rv %d: %s", rv, e.String())
+	}
+	if out.Len() != 0 {
+		t.Fatalf("unexpected output: %s", out.String())
+	}
+	buf, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if !strings.Contains(string(buf), "kafkabalancer_moves_needed_complete 0\n") {
+		t.Fatalf("missing expected string: %s", buf)
+	}
+	if _, err := os.Stat(name + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file not removed: %v", err)
+	}
+}
+
+func TestMainMetricsListenStdin(t *testing.T) {
+	out, e := &bytes.Buffer{}, &bytes.Buffer{}
+	rv := run(nil, out, e, []string{"kafkabalancer", "-metrics-listen=:0"})
+	if rv != 3 {
+		t.Fatalf("unexpected rv %d", rv)
+	}
+}
@@ -0,0 +1,63 @@
+// Package model contains the types describing the assignment of the
+// partitions of a kafka cluster to its brokers. PartitionList is both the
+// input of the balancer and, containing only the partitions to reassign, its
+// output; its JSON encoding is a superset of the one used by
+// kafka-reassign-partitions.sh.
+package model
+
+import "sort"
+
+type BrokerID int
+type PartitionID int
+type TopicName string
+
+// PartitionList is a list of partitions and their replicas
+type PartitionList struct {
+	Version    int         `json:"version"`
+	Partitions []Partition `json:"partitions"`
+}
+
+// Partition describes the replicas of a partition. The extensions fields
+// define the desired state of the partition and how it contributes to the load
+// of the brokers: unless otherwise noted, their zero value means the default.
+type Partition struct {
+	Topic     TopicName   `json:"topic"`
+	Partition PartitionID `json:"partition"`
+	Replicas  []BrokerID  `json:"replicas"`
+	// extensions
+	Weight       float64    `json:"weight,omitempty"`        // default: 1.0
+	NumReplicas  int        `json:"num_replicas,omitempty"`  // default: len(replicas)
+	Brokers      []BrokerID `json:"brokers,omitempty"`       // default: (auto)
+	NumConsumers int        `json:"num_consumers,omitempty"` // default: 1
+	Pinned       bool       `json:"pinned,omitempty"`        // default: false
+	Size         int64      `json:"size,omitempty"`          // bytes, default: 0 (unknown)
+	BytesIn      float64    `json:"bytes_in,omitempty"`      // bytes/s produced, default: 0 (unknown)
+	BytesOut     float64    `json:"bytes_out,omitempty"`     // bytes/s consumed, default: 0 (unknown)
+}
+
+// Copy returns a deep copy of the partition list
+func (pl *PartitionList) Copy() *PartitionList {
+	cpl := &PartitionList{Version: pl.Version, Partitions: make([]Partition, len(pl.Partitions))}
+	for idx, p := range pl.Partitions {
+		p.Replicas = append([]BrokerID(nil), p.Replicas...)
+		// an empty list of allowed brokers is not the same as the default one
+		if p.Brokers != nil {
+			p.Brokers = append(make([]BrokerID, 0, len(p.Brokers)), p.Brokers...)
+		}
+		cpl.Partitions[idx] = p
+	}
+
+	return cpl
+}
+
+// Sort sorts the partitions by topic and partition number, so that the
+// balancer doesn't depend on the order in which the partitions were listed
+func (pl *PartitionList) Sort() {
+	sort.SliceStable(pl.Partitions, func(i, j int) bool {
+		a, b := pl.Partitions[i], pl.Partitions[j]
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+		return a.Partition < b.Partition
+	})
+}
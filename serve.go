@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/cafxx/kafkabalancer/balancer"
+	"github.com/cafxx/kafkabalancer/codecs"
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+// maximum size of the body of the requests to the HTTP API
+const maxRequestSize = 64 << 20
+
+// apiConfig is the rebalancing configuration accepted by the HTTP API: the
+// fields not specified in a request default to the ones of the server
+type apiConfig struct {
+	AllowLeader   bool                        `json:"allow_leader"`
+	MinReplicas   int                         `json:"min_replicas"`
+	MinUnbalance  float64                     `json:"min_unbalance"`
+	Metric        string                      `json:"metric"`
+	LoadModel     *balancer.LoadModel         `json:"load_model"`
+	Affinities    []balancer.AffinityRule     `json:"affinities"`
+	CoPartitioned []balancer.CoPartitionGroup `json:"co_partitioned"`
+	Brokers       []model.BrokerID            `json:"brokers"`
+	Include       []string                    `json:"include"`
+	Exclude       []string                    `json:"exclude"`
+	Decommission  []model.BrokerID            `json:"decommission"`
+	Racks         map[model.BrokerID]string   `json:"racks"`
+	ScaleOut      []model.BrokerID            `json:"scale_out"`
+	MaxReassign   int                         `json:"max_reassign"`
+	MaxMovesFrom  int                         `json:"max_moves_from"`
+	MaxMovesTo    int                         `json:"max_moves_to"`
+}
+
+// apiRequest is the body of the POST requests to the HTTP API. Partitions
+// uses the same JSON format accepted by -input-json; it can be omitted in
+// what-if requests to use the partitions of the cluster of the server.
+// Scenario, only accepted by what-if requests, uses the same JSON format
+// accepted by -scenario.
+type apiRequest struct {
+	Partitions json.RawMessage `json:"partitions"`
+	Config     *apiConfig      `json:"config"`
+	Scenario   json.RawMessage `json:"scenario"`
+}
+
+// whatIfResponse is the body of the responses to the what-if requests: the
+// simulation of the scenario, if the request contains one, or the changes and
+// the reports of the cluster before and after applying them
+type whatIfResponse struct {
+	Changes    *model.PartitionList `json:"changes,omitempty"`
+	Before     *balancer.Report     `json:"before,omitempty"`
+	After      *balancer.Report     `json:"after,omitempty"`
+	Simulation *balancer.Simulation `json:"simulation,omitempty"`
+}
+
+type server struct {
+	load        func() (*model.PartitionList, error)
+	b           *balancer.Balancer
+	cfg         balancer.RebalanceConfig
+	maxReassign int
+}
+
+// newServer returns the handler of the HTTP API. The partition list of the
+// cluster returned by load (that can be nil, if no cluster is configured) is
+// used by the report and what-if endpoints. Requests taking longer than
+// timeout are aborted.
+func newServer(load func() (*model.PartitionList, error), b *balancer.Balancer, cfg balancer.RebalanceConfig, maxReassign int, timeout time.Duration) http.Handler {
+	cfg.Logger = nil
+	cfg.Explain = false
+	s := &server{load: load, b: b, cfg: cfg, maxReassign: maxReassign}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/plan", s.plan)
+	mux.HandleFunc("/report", s.report)
+	mux.HandleFunc("/whatif", s.whatIf)
+	if load != nil {
+		mux.Handle("/metrics", metricsHandler(load, b, cfg))
+	}
+
+	return http.TimeoutHandler(mux, timeout, "request timed out\n")
+}
+
+// plan returns the reassignments for the partitions in the request
+func (s *server) plan(w http.ResponseWriter, r *http.Request) {
+	pl, _, cfg, maxReassign, ok := s.parseRequest(w, r, false)
+	if !ok {
+		return
+	}
+
+	opl, _, _, err := plan(r.Context(), s.b, pl, cfg, maxReassign)
+	if err != nil {
+		httpError(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	if err = codecs.WritePartitionList(buf, opl); err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf.Bytes())
+}
+
+// report returns the report of the cluster, as JSON (default), text or
+// Prometheus metrics depending on the format query parameter
+func (s *server) report(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		httpError(w, fmt.Errorf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	if s.load == nil {
+		httpError(w, fmt.Errorf("no cluster configured"), http.StatusNotFound)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "text" && format != "prometheus" {
+		httpError(w, fmt.Errorf("invalid report format \"%s\"", format), http.StatusBadRequest)
+		return
+	}
+
+	pl, err := s.load()
+	if err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	rep, err := s.b.Report(r.Context(), pl, s.cfg, balancer.DefaultMaxMoves(pl))
+	if err != nil {
+		httpError(w, fmt.Errorf("failed computing report: %s", err), http.StatusUnprocessableEntity)
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	switch format {
+	case "text":
+		w.Header().Set("Content-Type", "text/plain")
+		err = codecs.WriteReport(buf, rep, false)
+	case "prometheus":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		err = codecs.WriteMetrics(buf, rep)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		err = codecs.WriteReport(buf, rep, true)
+	}
+	if err != nil {
+		httpError(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Write(buf.Bytes())
+}
+
+// whatIf returns the reassignments for the partitions in the request (or for
+// the cluster, if not specified) and the reports of the cluster before and
+// after applying them or, if the request contains a scenario, the simulation
+// of the scenario
+func (s *server) whatIf(w http.ResponseWriter, r *http.Request) {
+	pl, sc, cfg, maxReassign, ok := s.parseRequest(w, r, true)
+	if !ok {
+		return
+	}
+
+	res := &whatIfResponse{}
+	var err error
+	if sc != nil {
+		var maxMoves int
+		maxMoves, err = balancer.SimulateMaxMoves(pl, cfg, sc)
+		if err == nil {
+			res.Simulation, err = s.b.Simulate(r.Context(), pl, cfg, sc, maxMoves)
+		}
+		if err != nil {
+			httpError(w, fmt.Errorf("failed simulating scenario: %s", err), http.StatusUnprocessableEntity)
+			return
+		}
+	} else {
+		var state *model.PartitionList
+		res.Changes, state, _, err = plan(r.Context(), s.b, pl, cfg, maxReassign)
+		if err != nil {
+			httpError(w, err, http.StatusUnprocessableEntity)
+			return
+		}
+		res.Before, err = s.b.Report(r.Context(), pl, cfg, balancer.DefaultMaxMoves(pl))
+		if err == nil {
+			res.After, err = s.b.Report(r.Context(), state, cfg, balancer.DefaultMaxMoves(state))
+		}
+		if err != nil {
+			httpError(w, fmt.Errorf("failed computing report: %s", err), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err = json.NewEncoder(buf).Encode(res); err != nil {
+		httpError(w, fmt.Errorf("failed serializing json: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf.Bytes())
+}
+
+// parseRequest parses the body of a POST request, replying with an error if it
+// is not valid. If cluster is true and the request contains no partitions,
+// the partitions of the cluster are returned; scenarios are only accepted if
+// cluster is true.
+func (s *server) parseRequest(w http.ResponseWriter, r *http.Request, cluster bool) (*model.PartitionList, *balancer.Scenario, balancer.RebalanceConfig, int, bool) {
+	cfg := s.cfg
+	if r.Method != "POST" {
+		httpError(w, fmt.Errorf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return nil, nil, cfg, 0, false
+	}
+
+	// the decoder writes into the slices and maps it is given: the config of
+	// the server must not be modified by the request, so it gets copies
+	loadModel := balancer.DefaultLoadModel()
+	if cfg.LoadModel != nil {
+		loadModel = *cfg.LoadModel
+	}
+	req := apiRequest{Config: &apiConfig{
+		AllowLeader:   cfg.AllowLeaderRebalancing,
+		MinReplicas:   cfg.MinReplicasForRebalancing,
+		MinUnbalance:  cfg.MinUnbalance,
+		Metric:        cfg.Metric,
+		LoadModel:     &loadModel,
+		Affinities:    append([]balancer.AffinityRule(nil), cfg.Affinities...),
+		CoPartitioned: copyCoPartitioned(cfg.CoPartitioned),
+		Brokers:       copyBrokers(cfg.Brokers),
+		Include:       copyStrings(cfg.Include),
+		Exclude:       copyStrings(cfg.Exclude),
+		Decommission:  copyBrokers(cfg.Decommission),
+		Racks:         copyRacks(cfg.Racks),
+		ScaleOut:      copyBrokers(cfg.ScaleOut),
+		MaxReassign:   s.maxReassign,
+		MaxMovesFrom:  cfg.MaxMovesFrom,
+		MaxMovesTo:    cfg.MaxMovesTo,
+	}}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		httpError(w, fmt.Errorf("failed parsing request: %s", err), http.StatusBadRequest)
+		return nil, nil, cfg, 0, false
+	}
+	if req.Config == nil {
+		httpError(w, fmt.Errorf("invalid config"), http.StatusBadRequest)
+		return nil, nil, cfg, 0, false
+	}
+
+	c := req.Config
+	if c.MaxReassign < 0 {
+		httpError(w, fmt.Errorf("invalid number of max reassignments \"%d\"", c.MaxReassign), http.StatusBadRequest)
+		return nil, nil, cfg, 0, false
+	}
+	if c.MaxMovesFrom < 0 || c.MaxMovesTo < 0 {
+		httpError(w, fmt.Errorf("invalid maximum moves from \"%d\" or to \"%d\" each broker", c.MaxMovesFrom, c.MaxMovesTo), http.StatusBadRequest)
+		return nil, nil, cfg, 0, false
+	}
+	if _, err := balancer.LookupMetric(c.Metric); err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return nil, nil, cfg, 0, false
+	}
+	if c.LoadModel == nil {
+		httpError(w, fmt.Errorf("invalid load model"), http.StatusBadRequest)
+		return nil, nil, cfg, 0, false
+	}
+	if err := c.LoadModel.Validate(); err != nil {
+		httpError(w, err, http.StatusBadRequest)
+		return nil, nil, cfg, 0, false
+	}
+	for _, rule := range c.Affinities {
+		if err := rule.Validate(); err != nil {
+			httpError(w, err, http.StatusBadRequest)
+			return nil, nil, cfg, 0, false
+		}
+	}
+	for _, g := range c.CoPartitioned {
+		if err := g.Validate(); err != nil {
+			httpError(w, err, http.StatusBadRequest)
+			return nil, nil, cfg, 0, false
+		}
+	}
+	for _, pattern := range append(append([]string(nil), c.Include...), c.Exclude...) {
+		if _, err := balancer.CompileTopicPattern(pattern); err != nil {
+			httpError(w, err, http.StatusBadRequest)
+			return nil, nil, cfg, 0, false
+		}
+	}
+	cfg.AllowLeaderRebalancing = c.AllowLeader
+	cfg.MinReplicasForRebalancing = c.MinReplicas
+	cfg.MinUnbalance = c.MinUnbalance
+	cfg.Metric = c.Metric
+	cfg.LoadModel = c.LoadModel
+	cfg.Affinities = c.Affinities
+	cfg.CoPartitioned = c.CoPartitioned
+	cfg.MaxMovesFrom = c.MaxMovesFrom
+	cfg.MaxMovesTo = c.MaxMovesTo
+	cfg.Brokers = c.Brokers
+	cfg.Include = c.Include
+	cfg.Exclude = c.Exclude
+	cfg.Decommission = c.Decommission
+	cfg.Racks = c.Racks
+	cfg.ScaleOut = c.ScaleOut
+
+	var sc *balancer.Scenario
+	if len(req.Scenario) > 0 {
+		if !cluster {
+			httpError(w, fmt.Errorf("scenarios are only accepted by what-if requests"), http.StatusBadRequest)
+			return nil, nil, cfg, 0, false
+		}
+		var err error
+		sc, err = codecs.GetScenarioFromReader(bytes.NewReader(req.Scenario))
+		if err != nil {
+			httpError(w, fmt.Errorf("failed getting scenario: %s", err), http.StatusBadRequest)
+			return nil, nil, cfg, 0, false
+		}
+	}
+
+	var pl *model.PartitionList
+	var err error
+	switch {
+	case len(req.Partitions) > 0:
+		pl, err = codecs.GetPartitionListFromReader(bytes.NewReader(req.Partitions), true)
+		if err != nil {
+			httpError(w, fmt.Errorf("failed getting partition list: %s", err), http.StatusBadRequest)
+			return nil, nil, cfg, 0, false
+		}
+		pl.Sort()
+	case cluster && s.load != nil:
+		pl, err = s.load()
+		if err != nil {
+			httpError(w, err, http.StatusInternalServerError)
+			return nil, nil, cfg, 0, false
+		}
+	default:
+		httpError(w, fmt.Errorf("missing partitions"), http.StatusBadRequest)
+		return nil, nil, cfg, 0, false
+	}
+
+	return pl, sc, cfg, c.MaxReassign, true
+}
+
+func copyBrokers(l []model.BrokerID) []model.BrokerID {
+	if l == nil {
+		return nil
+	}
+	return append(make([]model.BrokerID, 0, len(l)), l...)
+}
+
+func copyStrings(l []string) []string {
+	if l == nil {
+		return nil
+	}
+	return append(make([]string, 0, len(l)), l...)
+}
+
+func copyRacks(m map[model.BrokerID]string) map[model.BrokerID]string {
+	if m == nil {
+		return nil
+	}
+	racks := make(map[model.BrokerID]string, len(m))
+	for id, rack := range m {
+		racks[id] = rack
+	}
+	return racks
+}
+
+func copyCoPartitioned(groups []balancer.CoPartitionGroup) []balancer.CoPartitionGroup {
+	if groups == nil {
+		return nil
+	}
+	copied := make([]balancer.CoPartitionGroup, 0, len(groups))
+	for _, g := range groups {
+		g.Topics = copyStrings(g.Topics)
+		copied = append(copied, g)
+	}
+	return copied
+}
+
+func httpError(w http.ResponseWriter, err error, code int) {
+	if code >= 500 {
+		log.Print(err)
+	}
+	http.Error(w, err.Error(), code)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cafxx/kafkabalancer/balancer"
+	"github.com/cafxx/kafkabalancer/codecs"
+	"github.com/cafxx/kafkabalancer/model"
+)
+
+func loadTestJSON() (*model.PartitionList, error) {
+	f, err := os.Open("test/test.json")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return codecs.GetPartitionListFromReader(f, true)
+}
+
+func newTestServer(load func() (*model.PartitionList, error)) *httptest.Server {
+	return httptest.NewServer(newServer(load, balancer.New(balancer.DefaultSteps()...), balancer.DefaultRebalanceConfig(), 1, time.Minute))
+}
+
+func doRequest(t *testing.T, method, url, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	defer res.Body.Close()
+	buf, _ := ioutil.ReadAll(res.Body)
+	return res.StatusCode, string(buf)
+}
+
+func TestServePlan(t *testing.T) {
+	s := newTestServer(nil)
+	defer s.Close()
+
+	partitions := `{"version":1,"partitions":[{"topic":"a","partition":1,"replicas":[1,2]},{"topic":"a","partition":2,"replicas":[1,2]}]}`
+	code, body := doRequest(t, "POST", s.URL+"/plan", `{"partitions":`+partitions+`,"config":{"brokers":[1,2,3],"max_reassign":5}}`)
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", code, body)
+	}
+	pl, err := codecs.GetPartitionListFromReader(strings.NewReader(body), true)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(pl.Partitions) != 1 || pl.Partitions[0].Replicas[1] != 3 {
+		t.Fatalf("unexpected plan %v", pl)
+	}
+
+	for _, c := range []struct {
+		method string
+		body   string
+		code   int
+	}{
+		{"GET", "", http.StatusMethodNotAllowed},
+		{"POST", "{", http.StatusBadRequest},
+		{"POST", `{"config":{}}`, http.StatusBadRequest},
+		{"POST", `{"partitions":` + partitions + `,"config":{"foo":1}}`, http.StatusBadRequest},
+		{"POST", `{"partitions":` + partitions + `,"config":{"include":["re:("]}}`, http.StatusBadRequest},
+		{"POST", `{"partitions":{"version":1,"partitions":[{"topic":"a","partition":1,"replicas":[1,1]}]}}`, http.StatusUnprocessableEntity},
+	} {
+		if code, body := doRequest(t, c.method, s.URL+"/plan", c.body); code != c.code {
+			t.Errorf("%s %s: unexpected status %d: %s", c.method, c.body, code, body)
+		}
+	}
+}
+
+func TestServeConfigUnchanged(t *testing.T) {
+	cfg := balancer.DefaultRebalanceConfig()
+	cfg.Brokers = []model.BrokerID{1, 2, 3}
+	cfg.Include = []string{"a"}
+	cfg.Exclude = []string{"b"}
+	cfg.Decommission = []model.BrokerID{3}
+	cfg.Racks = map[model.BrokerID]string{1: "a", 2: "b"}
+	cfg.ScaleOut = []model.BrokerID{2}
+	cfg.Affinities = []balancer.AffinityRule{{Topic: "a", With: "b"}}
+	cfg.CoPartitioned = []balancer.CoPartitionGroup{{Topics: []string{"a", "b"}}}
+	expected := balancer.DefaultRebalanceConfig()
+	expected.Brokers = []model.BrokerID{1, 2, 3}
+	expected.Include = []string{"a"}
+	expected.Exclude = []string{"b"}
+	expected.Decommission = []model.BrokerID{3}
+	expected.Racks = map[model.BrokerID]string{1: "a", 2: "b"}
+	expected.ScaleOut = []model.BrokerID{2}
+	expected.Affinities = []balancer.AffinityRule{{Topic: "a", With: "b"}}
+	expected.CoPartitioned = []balancer.CoPartitionGroup{{Topics: []string{"a", "b"}}}
+	s := httptest.NewServer(newServer(nil, balancer.New(balancer.DefaultSteps()...), cfg, 1, time.Minute))
+	defer s.Close()
+
+	partitions := `{"version":1,"partitions":[{"topic":"a","partition":1,"replicas":[7,8]},{"topic":"a","partition":2,"replicas":[7,8]}]}`
+	config := `{"brokers":[7,8,9],"include":["other"],"exclude":["other"],"decommission":[9],"racks":{"5":"z"},"scale_out":[9],` +
+		`"affinities":[{"topic":"x","with":"y","anti":true}],"co_partitioned":[{"topics":["x","y"],"leader_only":true}]}`
+	code, body := doRequest(t, "POST", s.URL+"/plan", `{"partitions":`+partitions+`,"config":`+config+`}`)
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", code, body)
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("server config modified by the request: %+v", cfg)
+	}
+}
+
+func TestServeReport(t *testing.T) {
+	s := newTestServer(loadTestJSON)
+	defer s.Close()
+
+	code, body := doRequest(t, "GET", s.URL+"/report", "")
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", code, body)
+	}
+	r := &balancer.Report{}
+	if err := json.Unmarshal([]byte(body), r); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(r.Brokers) != 4 || r.MovesNeeded == 0 {
+		t.Fatalf("unexpected report %v", r)
+	}
+
+	for format, expected := range map[string]string{"text": "BROKER", "prometheus": "kafkabalancer_unbalance "} {
+		code, body := doRequest(t, "GET", s.URL+"/report?format="+format, "")
+		if code != http.StatusOK || !strings.Contains(body, expected) {
+			t.Errorf("%s: unexpected response %d: %s", format, code, body)
+		}
+	}
+	if code, _ := doRequest(t, "GET", s.URL+"/report?format=xml", ""); code != http.StatusBadRequest {
+		t.Errorf("unexpected status %d", code)
+	}
+	if code, _ := doRequest(t, "GET", s.URL+"/metrics", ""); code != http.StatusOK {
+		t.Errorf("unexpected status %d", code)
+	}
+
+	s2 := newTestServer(nil)
+	defer s2.Close()
+	if code, _ := doRequest(t, "GET", s2.URL+"/report", ""); code != http.StatusNotFound {
+		t.Errorf("unexpected status %d", code)
+	}
+}
+
+func TestServeWhatIf(t *testing.T) {
+	s := newTestServer(loadTestJSON)
+	defer s.Close()
+
+	code, body := doRequest(t, "POST", s.URL+"/whatif", `{"config":{"decommission":[4],"max_reassign":10}}`)
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", code, body)
+	}
+	res := &whatIfResponse{}
+	if err := json.Unmarshal([]byte(body), res); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(res.Changes.Partitions) == 0 || len(res.Before.Brokers) != 4 || len(res.After.Brokers) != 3 {
+		t.Fatalf("unexpected response %s", body)
+	}
+
+	// with a scenario, the response is its simulation
+	scenario, err := ioutil.ReadFile("test/scenario.json")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	code, body = doRequest(t, "POST", s.URL+"/whatif", `{"config":{},"scenario":`+string(scenario)+`}`)
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", code, body)
+	}
+	res = &whatIfResponse{}
+	if err := json.Unmarshal([]byte(body), res); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if res.Changes != nil || res.Simulation == nil || res.Simulation.Moves == 0 || !res.Simulation.Converged || len(res.Simulation.Brokers) != 6 {
+		t.Fatalf("unexpected response %s", body)
+	}
+
+	// the moves of leaders never converge: the simulation is still bounded
+	code, body = doRequest(t, "POST", s.URL+"/whatif", `{"config":{"allow_leader":true},"scenario":{"version":1}}`)
+	if code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", code, body)
+	}
+	res = &whatIfResponse{}
+	if err := json.Unmarshal([]byte(body), res); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if res.Simulation == nil || res.Simulation.Converged || res.Simulation.Moves != 16 {
+		t.Fatalf("unexpected response %s", body)
+	}
+
+	for _, req := range []string{`{"config":{},"scenario":{"version":2}}`, `{"config":{},"scenario":{"version":1,"remove_brokers":[4],"foo":1}}`} {
+		if code, body := doRequest(t, "POST", s.URL+"/whatif", req); code != http.StatusBadRequest {
+			t.Errorf("unexpected status %d: %s", code, body)
+		}
+	}
+	if code, body := doRequest(t, "POST", s.URL+"/plan", `{"partitions":{"version":1,"partitions":[]},"config":{},"scenario":`+string(scenario)+`}`); code != http.StatusBadRequest {
+		t.Errorf("unexpected status %d: %s", code, body)
+	}
+}
+
+func TestServeTimeout(t *testing.T) {
+	load := func() (*model.PartitionList, error) {
+		time.Sleep(100 * time.Millisecond)
+		return loadTestJSON()
+	}
+	s := httptest.NewServer(newServer(load, balancer.New(balancer.DefaultSteps()...), balancer.DefaultRebalanceConfig(), 1, time.Millisecond))
+	defer s.Close()
+
+	if code, _ := doRequest(t, "GET", s.URL+"/report", ""); code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status %d", code)
+	}
+}